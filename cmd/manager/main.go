@@ -1,13 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/tennix/k8s-lvm-manager/pkg/manager"
+	"github.com/tennix/k8s-lvm-manager/pkg/metrics"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -30,6 +45,9 @@ type fsTab struct {
 }
 
 const (
+	// vgPublishDelay coalesces the changes of a burst of allocations into
+	// one update of the published VGs
+	vgPublishDelay         = 5 * time.Second
 	fstabFile              = "/etc/fstab"
 	AnnProvisionerNode     = "volume-provisioner.pingcap.com/node"
 	AnnProvisionerHostPath = "volume-provisioner.pingcap.com/hostpath"
@@ -38,13 +56,32 @@ const (
 )
 
 var (
-	kubeconfig string
-	baseDir    string
-	workers    int
-	fstab      fsTab
-	domainName string
-	fsType     string
-	duration   = 5 * time.Second
+	kubeconfig        string
+	baseDir           string
+	stateDir          string
+	configFile        string
+	workers           int
+	fstab             fsTab
+	domainName        string
+	fsType            string
+	discoverDryRun    bool
+	discoveryInterval time.Duration
+	maxRetries        int
+	metricsAddr       string
+	inventoryInterval time.Duration
+	watchDevices      bool
+	lockFile          string
+	auditFile         string
+	auditMaxSize      int64
+	auditMaxBackups   int
+	cgroupRoot        string
+	transferAddr      string
+	transferTokenFile string
+	transferCertFile  string
+	transferKeyFile   string
+	transferCAFile    string
+	transferName      string
+	managerSelector   string
 )
 
 func init() {
@@ -53,47 +90,368 @@ func init() {
 	flag.StringVar(&baseDir, "base-dir", "/data", "base directory for mount point")
 	flag.IntVar(&workers, "workers", 5, "count of workers for controller")
 	flag.StringVar(&fsType, "fs-type", "ext4", "LV fs type")
+	flag.StringVar(&stateDir, "state-dir", "/var/lib/lvm-manager", "directory for node local state of the manager")
+	flag.StringVar(&configFile, "config", "", "Path to manager config file")
+	flag.BoolVar(&discoverDryRun, "discover-dry-run", false, "print the disk discovery plan and exit")
+	flag.IntVar(&maxRetries, "max-retries", 15, "max retries of syncing a PVC before marking it as failed")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":10263", "address of the metrics and health check http server")
+	flag.DurationVar(&discoveryInterval, "discovery-interval", time.Minute, "interval of disk discovery and LV import, 0 means only on startup")
+	flag.DurationVar(&inventoryInterval, "inventory-refresh-interval", time.Minute, "interval of rescanning LVM, the cached LVM status is also refreshed after changes made by the manager")
+	flag.BoolVar(&watchDevices, "watch-devices", true, "refresh the cached LVM status once device-mapper devices are created or removed")
+	flag.StringVar(&lockFile, "lock-file", "/run/lock/lvm-manager.lock", "advisory lock file taken while changing LVM, scripts can take it with flock(1), empty to disable")
+	flag.StringVar(&auditFile, "audit-file", "/var/lib/lvm-manager/audit.log", "JSON lines journal of the commands changing the node storage, empty to disable")
+	flag.Int64Var(&auditMaxSize, "audit-max-size", 100<<20, "size in bytes of the audit journal before it's rotated")
+	flag.IntVar(&auditMaxBackups, "audit-max-backups", 5, "count of rotated audit journals to keep")
+	flag.StringVar(&cgroupRoot, "cgroup-root", "/sys/fs/cgroup", "mount point of the cgroup v2 hierarchy of the host, where IO limits of pods are set, empty to disable IO limits")
+	flag.StringVar(&transferAddr, "transfer-addr", ":10265", "address of the server receiving volumes migrated from other nodes")
+	flag.StringVar(&transferTokenFile, "transfer-token-file", "", "file of the token shared by the managers to transfer volumes, the transfer is disabled if it's empty or the file is missing")
+	flag.StringVar(&transferCertFile, "transfer-cert-file", "", "TLS certificate of the transfer server, required if the transfer is enabled")
+	flag.StringVar(&transferKeyFile, "transfer-key-file", "", "TLS key of the transfer server, required if the transfer is enabled")
+	flag.StringVar(&transferCAFile, "transfer-ca-file", "", "CA verifying the transfer servers of other nodes, defaults to --transfer-cert-file shared by the managers")
+	flag.StringVar(&transferName, "transfer-server-name", "lvm-volume-manager-transfer", "name in the certificates of the transfer servers, they are reached by pod IP")
+	flag.StringVar(&managerSelector, "manager-pod-selector", "app=lvm-volume-manager", "label selector of the manager pods to transfer volumes to")
 	flag.Parse()
 
 }
 
 func main() {
+	if flag.Arg(0) == "audit" {
+		queryAudit(flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "decommission" {
+		decommissionNode(flag.Args()[1:])
+		return
+	}
 	nodeName := os.Getenv("MY_NODE_NAME")
 	if nodeName == "" {
 		glog.Fatalf("MY_NODE_NAME environment variable not set")
 	}
 
-	mgr := manager.LVManager{BaseDir: baseDir}
+	cfg, err := manager.LoadConfig(configFile)
+	if err != nil {
+		glog.Fatalf("failed to load config: %v", err)
+	}
+	mgr := manager.LVManager{BaseDir: baseDir, StateDir: stateDir, Inventory: manager.NewInventory(), LockFile: lockFile, CgroupRoot: cgroupRoot}
+	if auditFile != "" {
+		mgr.Audit = manager.NewAuditLog(auditFile, auditMaxSize, auditMaxBackups)
+	}
+
+	if discoverDryRun {
+		plans, err := mgr.PlanDiscovery(cfg.Discovery)
+		if err != nil {
+			glog.Fatalf("failed to plan disk discovery: %v", err)
+		}
+		for _, plan := range plans {
+			fmt.Println(plan)
+		}
+		return
+	}
+	discover(&mgr, cfg)
 
 	provisionerName := fmt.Sprintf("%s/lvm-volume-provisioner", domainName)
 
 	if err := mgr.SyncLVMStatus(); err != nil {
 		glog.Fatalf("failed to sync lvm status: %v", err)
 	}
+	glog.Infof("LVM: %+v", mgr.VGs())
+
+	cli := newKubeClient()
+
+	controller := manager.NewController(cli, mgr, domainName, nodeName, provisionerName, maxRetries)
+
+	if err := publishVGs(controller, managedVGs(mgr.VGs(), cfg)); err != nil {
+		glog.Fatalf("failed to update node status: %v", err)
+	}
+	if err := controller.ImportLVs(mgr.VGs(), managedVGs(mgr.VGs(), cfg), cfg.Import, cfg.ImportStorageClass); err != nil {
+		// retried by the periodic discovery if enabled, the other volumes are
+		// still managed
+		glog.Errorf("failed to import LVs: %v", err)
+	}
+	if err := controller.RecoverIntents(); err != nil {
+		glog.Fatalf("failed to recover provisioning intents: %v", err)
+	}
+	if err := controller.ReopenEncryptedLVs(); err != nil {
+		glog.Fatalf("failed to reopen encrypted LVs: %v", err)
+	}
+	if err := controller.ResumeReleases(); err != nil {
+		glog.Fatalf("failed to resume releasing LVs: %v", err)
+	}
+	stopCh := make(chan struct{})
+	if discoveryInterval > 0 {
+		go wait.Until(func() {
+			if controller.Decommissioning() {
+				return
+			}
+			if discover(&mgr, cfg) {
+				if err := publishVGs(controller, managedVGs(mgr.VGs(), cfg)); err != nil {
+					glog.Errorf("failed to update node status: %v", err)
+				}
+			}
+			if err := controller.ImportLVs(mgr.VGs(), managedVGs(mgr.VGs(), cfg), cfg.Import, cfg.ImportStorageClass); err != nil {
+				glog.Errorf("failed to import LVs: %v", err)
+			}
+		}, discoveryInterval, stopCh)
+	}
+	metrics.RegisterHandlers(http.DefaultServeMux, func() error {
+		_, err := cli.Discovery().ServerVersion()
+		return err
+	})
+	go func() {
+		glog.Infof("start metrics server, listening on %s", metricsAddr)
+		if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+			glog.Fatalf("failed to start metrics server: %v", err)
+		}
+	}()
+	// the secret of the transfer is optional, the volumes of the node can't
+	// be migrated without it
+	for _, file := range []string{transferTokenFile, transferCertFile, transferKeyFile} {
+		if file == "" || transferTokenFile == "" {
+			continue
+		}
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			glog.Warningf("%s is not found, volume transfer is disabled", file)
+			transferTokenFile = ""
+		}
+	}
+	if transferTokenFile != "" {
+		token, err := ioutil.ReadFile(transferTokenFile)
+		if err != nil {
+			glog.Fatalf("failed to read transfer token: %v", err)
+		}
+		if strings.TrimSpace(string(token)) == "" {
+			glog.Fatalf("transfer token in %s is empty", transferTokenFile)
+		}
+		_, port, err := net.SplitHostPort(transferAddr)
+		if err != nil {
+			glog.Fatalf("invalid transfer address %s: %v", transferAddr, err)
+		}
+		transferPort, err := strconv.Atoi(port)
+		if err != nil {
+			glog.Fatalf("invalid transfer address %s: %v", transferAddr, err)
+		}
+		if transferCertFile == "" || transferKeyFile == "" {
+			glog.Fatalf("--transfer-cert-file and --transfer-key-file are required to transfer volumes")
+		}
+		cert, err := tls.LoadX509KeyPair(transferCertFile, transferKeyFile)
+		if err != nil {
+			glog.Fatalf("failed to load transfer certificate: %v", err)
+		}
+		if transferCAFile == "" {
+			transferCAFile = transferCertFile
+		}
+		ca, err := ioutil.ReadFile(transferCAFile)
+		if err != nil {
+			glog.Fatalf("failed to read transfer CA: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			glog.Fatalf("no certificate found in transfer CA %s", transferCAFile)
+		}
+		mux := http.NewServeMux()
+		controller.ServeTransfer(mux, manager.TransferOptions{
+			Token:       strings.TrimSpace(string(token)),
+			Port:        transferPort,
+			PodSelector: managerSelector,
+			TLSConfig: &tls.Config{
+				RootCAs:    roots,
+				ServerName: transferName,
+				MinVersion: tls.VersionTLS12,
+			},
+		})
+		server := &http.Server{
+			Addr:    transferAddr,
+			Handler: mux,
+			TLSConfig: &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			},
+			// the volumes are streamed in the bodies, only the headers are
+			// bounded
+			ReadHeaderTimeout: 30 * time.Second,
+		}
+		go func() {
+			glog.Infof("start transfer server, listening on %s", transferAddr)
+			if err := server.ListenAndServeTLS("", ""); err != nil {
+				glog.Fatalf("failed to start transfer server: %v", err)
+			}
+		}()
+	}
+	go mgr.Inventory.Run(inventoryInterval, watchDevices, stopCh)
+	go republishVGs(controller, &mgr, cfg, stopCh)
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-sigCh
+		glog.Infof("received signal %s, shutting down", sig)
+		close(stopCh)
+	}()
+	controller.Run(workers, stopCh)
+	glog.Flush()
+}
+
+// discover adds unused disks to the configured VGs, it returns true if any
+// VG has been changed
+func discover(mgr *manager.LVManager, cfg *manager.Config) bool {
+	if len(cfg.Discovery) == 0 {
+		return false
+	}
+	plans, err := mgr.PlanDiscovery(cfg.Discovery)
+	if err != nil {
+		glog.Errorf("failed to plan disk discovery: %v", err)
+		return false
+	}
+	if err := mgr.ApplyDiscovery(plans); err != nil {
+		glog.Errorf("failed to apply disk discovery: %v", err)
+	}
+	return len(plans) > 0
+}
+
+func publishVGs(controller *manager.Controller, vgs map[string]manager.VolumeGroup) error {
+	if err := controller.UpdateNodeStatus(vgs); err != nil {
+		return err
+	}
+	return controller.UpdateNodeVGs(vgs)
+}
+
+// republishVGs publishes the free space of the VGs once the inventory
+// changes, so that the scheduler sees the space taken by allocations and
+// released by removals. The VGs are only published if they differ from the
+// last published ones.
+func republishVGs(controller *manager.Controller, mgr *manager.LVManager, cfg *manager.Config, stopCh <-chan struct{}) {
+	var published []byte
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-mgr.Inventory.Changed():
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(vgPublishDelay):
+		}
+		// the VGs are removed and unpublished by the decommission
+		if controller.Decommissioning() {
+			continue
+		}
+		vgs := managedVGs(mgr.VGs(), cfg)
+		data, err := json.Marshal(manager.NodeVGInfos(vgs))
+		if err != nil || bytes.Equal(data, published) {
+			continue
+		}
+		if err := controller.UpdateNodeVGs(vgs); err != nil {
+			glog.Errorf("failed to update VGs of node: %v", err)
+			continue
+		}
+		published = data
+	}
+}
+
+// managedVGs returns the VGs published as node extended resources, the VGs
+// of discovery rules and the ones matching the VG selector of the config
+func managedVGs(vgs map[string]manager.VolumeGroup, cfg *manager.Config) map[string]manager.VolumeGroup {
+	names := map[string]bool{"loopback-disk": true}
+	for _, rule := range cfg.Discovery {
+		names[rule.VGName] = true
+	}
+	managed := map[string]manager.VolumeGroup{}
+	for name, vg := range vgs {
+		if names[name] || (cfg.VGSelector != nil && util.MatchVGSelector(*cfg.VGSelector, vg.Tags)) {
+			managed[name] = vg
+		}
+	}
+	return managed
+}
+
+// queryAudit prints the audit records of a PVC or LV, e.g.
+// lvm-volume-manager audit --pvc default/data-0
+func queryAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	pvc := fs.String("pvc", "", "namespace/name of the PVC")
+	lv := fs.String("lv", "", "name of the LV, or vg/lv")
+	fs.Parse(args)
+	if *pvc == "" && *lv == "" {
+		fmt.Fprintln(os.Stderr, "usage: lvm-volume-manager [--audit-file=<file>] audit --pvc <namespace>/<name> | --lv [<vg>/]<lv>")
+		os.Exit(2)
+	}
+	records, err := manager.QueryAuditLog(auditFile, auditMaxBackups, func(r manager.AuditRecord) bool {
+		if *pvc != "" && r.PVCNamespace+"/"+r.PVCName != *pvc {
+			return false
+		}
+		if *lv != "" && r.LVName != *lv && r.VGName+"/"+r.LVName != *lv {
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		glog.Fatalf("failed to query audit journal %s: %v", auditFile, err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, record := range records {
+		enc.Encode(record)
+	}
+}
+
+func newKubeClient() kubernetes.Interface {
+	var restCfg *rest.Config
 	var err error
-	var cfg *rest.Config
 	if kubeconfig == "" {
-		cfg, err = rest.InClusterConfig()
+		restCfg, err = rest.InClusterConfig()
 	} else {
-		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		restCfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 	}
 	if err != nil {
 		glog.Fatalf("failed to get kube config: %v", err)
 	}
-
-	glog.Infof("LVM: %+v", mgr.LVM)
-
-	cli, err := kubernetes.NewForConfig(cfg)
+	cli, err := kubernetes.NewForConfig(restCfg)
 	if err != nil {
 		glog.Fatalf("failed to get kubernetes clientset: %v", err)
 	}
+	return cli
+}
 
-	controller := manager.NewController(cli, mgr, domainName, nodeName, provisionerName)
-
-	if err := controller.UpdateNodeStatus(mgr.LVM); err != nil {
-		glog.Fatalf("failed to update node status: %v", err)
+// decommissionNode starts, cancels or shows the decommission of a node, e.g.
+// lvm-volume-manager decommission --node node-1 --target node-2
+func decommissionNode(args []string) {
+	fs := flag.NewFlagSet("decommission", flag.ExitOnError)
+	node := fs.String("node", "", "name of the node to decommission")
+	target := fs.String("target", "", "node the volumes are copied to, the owners of the PVCs must migrate or delete them if it's empty")
+	cancel := fs.Bool("cancel", false, "cancel the decommission, the removed VGs are created again by disk discovery")
+	status := fs.Bool("status", false, "print the decommission status")
+	fs.Parse(args)
+	if *node == "" {
+		fmt.Fprintln(os.Stderr, "usage: lvm-volume-manager [--kubeconfig=<file>] decommission --node <node> [--target <node>] [--cancel] [--status]")
+		os.Exit(2)
+	}
+	nodes := newKubeClient().CoreV1().Nodes()
+	if *status {
+		n, err := nodes.Get(*node, metav1.GetOptions{})
+		if err != nil {
+			glog.Fatalf("failed to get node %s: %v", *node, err)
+		}
+		fmt.Println(n.Annotations[util.AnnNodeDecommissionStatus])
+		return
+	}
+	annotations := map[string]interface{}{
+		util.AnnNodeDecommission:       "true",
+		util.AnnNodeDecommissionTarget: *target,
+		util.AnnNodeDecommissionStatus: nil,
+	}
+	if *target == "" {
+		annotations[util.AnnNodeDecommissionTarget] = nil
+	}
+	if *cancel {
+		annotations[util.AnnNodeDecommission] = nil
+		annotations[util.AnnNodeDecommissionTarget] = nil
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		glog.Fatalf("failed to marshal patch: %v", err)
+	}
+	if _, err := nodes.Patch(*node, types.MergePatchType, data); err != nil {
+		glog.Fatalf("failed to patch node %s: %v", *node, err)
 	}
-	wait.Forever(func() {
-		controller.Run(workers, wait.NeverStop)
-	}, duration)
 }
@@ -3,10 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
+	"github.com/tennix/k8s-lvm-manager/pkg/metrics"
 	"github.com/tennix/k8s-lvm-manager/pkg/provisioner"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
@@ -18,6 +20,7 @@ var (
 	kubeconfig  string
 	kubeVersion string
 	domainName  string
+	metricsAddr string
 	duration    = 5 * time.Second
 )
 
@@ -25,6 +28,7 @@ func init() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig file, omit this if run in cluster")
 	flag.StringVar(&kubeVersion, "kube-version", "v1.7", "kubernetes version")
 	flag.StringVar(&domainName, "domain-name", "pingcap.com", "domain name of extended resource")
+	flag.StringVar(&metricsAddr, "metrics-addr", ":10264", "address of the metrics and health check http server")
 	flag.Parse()
 }
 
@@ -54,6 +58,16 @@ func main() {
 		prov,
 		kubeVersion,
 	)
+	metrics.RegisterHandlers(http.DefaultServeMux, func() error {
+		_, err := kubeCli.Discovery().ServerVersion()
+		return err
+	})
+	go func() {
+		glog.Infof("start metrics server, listening on %s", metricsAddr)
+		if err := http.ListenAndServe(metricsAddr, nil); err != nil {
+			glog.Fatalf("failed to start metrics server: %v", err)
+		}
+	}()
 	wait.Forever(func() {
 		pc.Run(wait.NeverStop)
 	}, duration)
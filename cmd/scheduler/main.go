@@ -19,12 +19,14 @@ var (
 	port         int
 	storageClass string
 	domainName   string
+	lvNameTpl    string
 )
 
 func init() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "Path to kubeconfig file, omit this if run in cluster")
 	flag.StringVar(&storageClass, "storage-class", "lvm-volume-provisioner", "storage class for volume provisioner")
 	flag.StringVar(&domainName, "domain-name", "pingcap.com", "domain name of extended resource")
+	flag.StringVar(&lvNameTpl, "lv-name-template", util.DefaultLVNameTemplate, "template of LV names, fields .Namespace, .Name and .UID of the PVC are available")
 	flag.IntVar(&port, "port", 10262, "The port that the tidb scheduler's http service runs on (default 10262)")
 	flag.Parse()
 }
@@ -50,6 +52,6 @@ func main() {
 
 	glog.Infof("start listening on :%d", port)
 	wait.Forever(func() {
-		scheduler.StartServer(kubeCli, port, domainName, storageClass)
+		scheduler.StartServer(kubeCli, port, domainName, storageClass, lvNameTpl)
 	}, duration)
 }
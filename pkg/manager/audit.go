@@ -0,0 +1,197 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Operation identifies why and for which volume the node storage is changed,
+// it's recorded with every command in the audit journal
+type Operation struct {
+	Trigger      string `json:"trigger,omitempty"`
+	PVCNamespace string `json:"pvcNamespace,omitempty"`
+	PVCName      string `json:"pvcName,omitempty"`
+	PVName       string `json:"pvName,omitempty"`
+	VGName       string `json:"vgName,omitempty"`
+	LVName       string `json:"lvName,omitempty"`
+}
+
+// AuditRecord is a line of the audit journal
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	Operation
+	Command  string   `json:"command"`
+	Args     []string `json:"args,omitempty"`
+	Duration float64  `json:"durationSeconds"`
+	Result   string   `json:"result"`
+	ExitCode int      `json:"exitCode,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// AuditLog appends records to a JSON lines file, the file is rotated once
+// it's larger than maxSize and at most maxBackups rotated files are kept
+type AuditLog struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewAuditLog(path string, maxSize int64, maxBackups int) *AuditLog {
+	return &AuditLog{path: path, maxSize: maxSize, maxBackups: maxBackups}
+}
+
+// Append writes the record to the journal
+func (a *AuditLog) Append(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil && a.maxSize > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	if a.file == nil {
+		if err := os.MkdirAll(path.Dir(a.path), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		a.file, a.size = f, info.Size()
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+// rotate renames <path> to <path>.1, <path>.1 to <path>.2 and so on
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		glog.Errorf("failed to close audit journal %s: %v", a.path, err)
+	}
+	a.file = nil
+	os.Remove(backupPath(a.path, a.maxBackups))
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(a.path, i), backupPath(a.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if a.maxBackups == 0 {
+		return os.Remove(a.path)
+	}
+	return os.Rename(a.path, backupPath(a.path, 1))
+}
+
+func backupPath(file string, i int) string {
+	return fmt.Sprintf("%s.%d", file, i)
+}
+
+// QueryAuditLog returns the records of the journal and its rotated files
+// matching the filter, oldest first
+func QueryAuditLog(file string, maxBackups int, match func(AuditRecord) bool) ([]AuditRecord, error) {
+	var files []string
+	for i := maxBackups; i >= 1; i-- {
+		files = append(files, backupPath(file, i))
+	}
+	files = append(files, file)
+	var records []AuditRecord
+	for _, name := range files {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var record AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				glog.Warningf("skip invalid audit record in %s: %v", name, err)
+				continue
+			}
+			if match(record) {
+				records = append(records, record)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// WithOperation returns a copy of the manager recording the operation with
+// the commands it runs
+func (m LVManager) WithOperation(op Operation) *LVManager {
+	m.op = op
+	return &m
+}
+
+// runAudited runs a command changing the node storage and records it in
+// the audit journal
+func (m *LVManager) runAudited(stdin []byte, name string, args ...string) ([]byte, error) {
+	start := time.Now()
+	output, err := runCommand(stdin, name, args...)
+	m.audit(name, args, start, err)
+	return output, err
+}
+
+// runLVMAudited is runAudited for LVM commands
+func (m *LVManager) runLVMAudited(name string, args ...string) ([]byte, error) {
+	start := time.Now()
+	output, err := runLVM(name, args...)
+	m.audit(name, args, start, err)
+	return output, err
+}
+
+func (m *LVManager) audit(name string, args []string, start time.Time, err error) {
+	if m.Audit == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:      start,
+		Operation: m.op,
+		Command:   name,
+		Args:      args,
+		Duration:  time.Since(start).Seconds(),
+		Result:    "success",
+	}
+	if err != nil {
+		record.Result = "error"
+		record.Error = err.Error()
+		if cmdErr, ok := err.(*CommandError); ok {
+			record.ExitCode = cmdErr.ExitCode
+			record.Stderr = cmdErr.Stderr
+			record.Error = cmdErr.Err.Error()
+		}
+	}
+	if err := m.Audit.Append(record); err != nil {
+		glog.Errorf("failed to append audit record %s %s: %v", name, strings.Join(args, " "), err)
+	}
+}
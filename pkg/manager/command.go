@@ -0,0 +1,222 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// defaultCommandTimeout bounds the commands without their own timeout
+const defaultCommandTimeout = 5 * time.Minute
+
+// commandTimeouts are the timeouts of the commands which may take much
+// shorter or longer than defaultCommandTimeout
+var commandTimeouts = map[string]time.Duration{
+	"vgs":        time.Minute,
+	"pvs":        time.Minute,
+	"lvs":        time.Minute,
+	"blkid":      time.Minute,
+	"mount":      2 * time.Minute,
+	"umount":     2 * time.Minute,
+	"wipefs":     2 * time.Minute,
+	"mkfs":       30 * time.Minute,
+	"blkdiscard": 30 * time.Minute,
+	"resize2fs":  30 * time.Minute,
+	"xfs_growfs": 30 * time.Minute,
+}
+
+func commandTimeout(name string) time.Duration {
+	if timeout, ok := commandTimeouts[name]; ok {
+		return timeout
+	}
+	return defaultCommandTimeout
+}
+
+// CommandErrorReason classifies the failure of a command by its stderr
+type CommandErrorReason string
+
+const (
+	ReasonUnknown           CommandErrorReason = "Unknown"
+	ReasonTimeout           CommandErrorReason = "Timeout"
+	ReasonInsufficientSpace CommandErrorReason = "InsufficientSpace"
+	ReasonVGNotFound        CommandErrorReason = "VGNotFound"
+	ReasonDeviceBusy        CommandErrorReason = "DeviceBusy"
+	ReasonAlreadyExists     CommandErrorReason = "AlreadyExists"
+	ReasonLockContention    CommandErrorReason = "LockContention"
+	// ReasonLayoutUnfit is returned before lvcreate if the VG doesn't have
+	// enough PVs with enough free space for a striped or raid LV, the PVC
+	// isn't rescheduled as the scheduler may see stale free space
+	ReasonLayoutUnfit CommandErrorReason = "LayoutUnfit"
+	// ReasonNameConflict is returned if a LV of the name exists but isn't
+	// created for the PVC
+	ReasonNameConflict CommandErrorReason = "NameConflict"
+)
+
+// stderr patterns of LVM and util-linux commands, the first match wins
+var commandErrorPatterns = []struct {
+	reason  CommandErrorReason
+	pattern *regexp.Regexp
+}{
+	{ReasonLockContention, regexp.MustCompile(`(?i)(failed to lock|can't get lock|lock failed|resource temporarily unavailable)`)},
+	{ReasonInsufficientSpace, regexp.MustCompile(`(?i)(insufficient free (space|extents)|not enough free space)`)},
+	{ReasonVGNotFound, regexp.MustCompile(`(?i)(volume group "[^"]*" not found|cannot process volume group)`)},
+	{ReasonAlreadyExists, regexp.MustCompile(`(?i)already exists`)},
+	{ReasonDeviceBusy, regexp.MustCompile(`(?i)(device or resource busy|target is busy|in use|contains a mounted filesystem)`)},
+}
+
+// CommandError is returned by runCommand when a command fails, it carries
+// the stderr and the classified reason of the failure
+type CommandError struct {
+	Command  string
+	Args     []string
+	ExitCode int
+	Stderr   string
+	Reason   CommandErrorReason
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("%s %s: %v", e.Command, strings.Join(e.Args, " "), e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+// Retryable reports whether the command may succeed if run again later
+func (e *CommandError) Retryable() bool {
+	switch e.Reason {
+	case ReasonTimeout, ReasonDeviceBusy, ReasonLockContention, ReasonUnknown:
+		return true
+	}
+	return false
+}
+
+// commandErrorReason returns the reason of a CommandError, or ReasonUnknown
+// for any other error
+func commandErrorReason(err error) CommandErrorReason {
+	if cmdErr, ok := err.(*CommandError); ok {
+		return cmdErr.Reason
+	}
+	return ReasonUnknown
+}
+
+func classifyStderr(stderr string) CommandErrorReason {
+	for _, p := range commandErrorPatterns {
+		if p.pattern.MatchString(stderr) {
+			return p.reason
+		}
+	}
+	return ReasonUnknown
+}
+
+// runCommand runs the command with stdin and returns its stdout, the
+// command and all its children are killed once its timeout expires
+func runCommand(stdin []byte, name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout(name))
+	defer cancel()
+	return runCommandContext(ctx, stdin, name, args...)
+}
+
+func runCommandContext(ctx context.Context, stdin []byte, name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	var in io.Reader
+	if stdin != nil {
+		in = bytes.NewReader(stdin)
+	}
+	err := runCommandStream(ctx, in, &stdout, name, args...)
+	return stdout.Bytes(), err
+}
+
+// runCommandStream runs the command reading stdin and writing stdout until
+// it exits or ctx is done, it's used to stream volume data
+func runCommandStream(ctx context.Context, stdin io.Reader, stdout io.Writer, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	// run in its own process group so that helpers forked by the command,
+	// e.g. fsadm by lvextend, are killed with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdin = stdin
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			glog.Errorf("%s %s is stopped: %v, killing its process group", name, strings.Join(args, " "), ctx.Err())
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			err = <-done
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	cmdErr := &CommandError{
+		Command:  name,
+		Args:     args,
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Err:      err,
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			cmdErr.ExitCode = status.ExitStatus()
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		cmdErr.Reason = ReasonTimeout
+	} else {
+		cmdErr.Reason = classifyStderr(cmdErr.Stderr)
+	}
+	return cmdErr
+}
+
+// LVM commands failed to get the LVM locks held by other LVM users are
+// retried with exponential backoff
+const (
+	lvmLockRetries    = 6
+	lvmLockRetryDelay = time.Second
+)
+
+// runLVM runs a LVM command and records its latency and errors, it's retried
+// with backoff on lock contention
+func runLVM(name string, args ...string) ([]byte, error) {
+	delay := lvmLockRetryDelay
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		output, err := runCommand(nil, name, args...)
+		lvmCommandDuration.Observe(time.Since(start).Seconds(), name)
+		if err == nil {
+			return output, nil
+		}
+		lvmCommandErrors.Inc(name)
+		if commandErrorReason(err) != ReasonLockContention || attempt >= lvmLockRetries {
+			return output, err
+		}
+		lvmCommandRetries.Inc(name)
+		glog.Warningf("%s failed on lock contention, retry in %v: %v", name, delay, err)
+		time.Sleep(wait.Jitter(delay, 0.1))
+		delay *= 2
+	}
+}
+
+// exitCode returns the exit code of a failed command, or -1 if it didn't
+// exit normally
+func exitCode(err error) int {
+	if cmdErr, ok := err.(*CommandError); ok {
+		return cmdErr.ExitCode
+	}
+	return -1
+}
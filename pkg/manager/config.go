@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+)
+
+// Config is the node level configuration of the LVM volume manager
+type Config struct {
+	Discovery []DiscoveryRule `json:"discovery,omitempty"`
+	Import    []ImportRule    `json:"import,omitempty"`
+	// ImportStorageClass is the storage class of imported PVs by default
+	ImportStorageClass string `json:"importStorageClass,omitempty"`
+	// VGSelector publishes the VGs created by hand whose tags match it, in
+	// addition to the VGs of discovery rules, e.g. tier=ssd. A selector of
+	// no tags publishes every VG.
+	VGSelector *string `json:"vgSelector,omitempty"`
+}
+
+// DiscoveryRule describes which block devices should be collected into a VG
+type DiscoveryRule struct {
+	// DevicePaths are globs of device paths, e.g. /dev/sd[b-z]
+	DevicePaths []string `json:"devicePaths,omitempty"`
+	// ByIDPatterns are globs relative to /dev/disk/by-id, e.g. nvme-INTEL*
+	ByIDPatterns []string `json:"byIdPatterns,omitempty"`
+	// MinSize is the minimum size of a device, e.g. 100Gi
+	MinSize string   `json:"minSize,omitempty"`
+	VGName  string   `json:"vgName"`
+	VGTags  []string `json:"vgTags,omitempty"`
+}
+
+func LoadConfig(file string) (*Config, error) {
+	cfg := &Config{}
+	if file == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		glog.Errorf("failed to read config file %s: %v", file, err)
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		glog.Errorf("failed to parse config file %s: %v", file, err)
+		return nil, err
+	}
+	return cfg, nil
+}
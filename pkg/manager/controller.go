@@ -1,12 +1,17 @@
 package manager
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/metrics"
 	"github.com/tennix/k8s-lvm-manager/pkg/util"
 	"k8s.io/api/core/v1"
 	apierr "k8s.io/apimachinery/pkg/api/errors"
@@ -18,9 +23,16 @@ import (
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 )
 
+const (
+	cacheStatsInterval = time.Minute
+	autoGrowInterval   = time.Minute
+	encryptionKeySize  = 64
+)
+
 type NodePatch struct {
 	Op    string `json:"op"`
 	Path  string `json:"path"`
@@ -34,20 +46,52 @@ type Controller struct {
 	provisionerName string
 	kubeCli         kubernetes.Interface
 
-	controller cache.Controller
-	store      cache.Store
-	queue      *workqueue.Type
+	controller    cache.Controller
+	store         cache.Store
+	podController cache.Controller
+	queue         workqueue.RateLimitingInterface
+	maxRetries    int
+	recorder      record.EventRecorder
+	stopCh        <-chan struct{}
+
+	// volumeProblems are the problems of the PVCs last reported by events,
+	// only accessed by the health check
+	volumeProblems map[string]string
+	// decommissioning is 1 if the node is being decommissioned
+	decommissioning int32
+	// migrationsPending is 1 while the migrations from this node may be
+	// unfinished, the PVs are only listed to resume them meanwhile
+	migrationsPending int32
+	// transfer is nil unless volumes can be transferred to other nodes
+	transfer *TransferOptions
+	// transferHTTP sends volumes to the transfer servers of other nodes
+	transferHTTP *http.Client
+
+	// cacheStats are the cache statistics last reported in the PVs, only
+	// accessed by reportCacheStats
+	cacheStats map[string]string
+
+	eraseLock sync.Mutex
+	eraseJobs map[string]*eraseJob
 }
 
-func NewController(cli kubernetes.Interface, lvm LVManager, domainName, nodeName, provisionerName string) *Controller {
+// NewController creates the LVM controller, a PVC failed to sync more than
+// maxRetries times is marked as failed and not retried until it's updated
+func NewController(cli kubernetes.Interface, lvm LVManager, domainName, nodeName, provisionerName string, maxRetries int) *Controller {
 	ctrl := &Controller{
 		kubeCli:         cli,
 		nodeName:        nodeName,
 		provisionerName: provisionerName,
 		domainName:      domainName,
 		lvm:             lvm,
-		queue:           workqueue.New(),
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "lvm_manager_pvc"),
+		maxRetries:      maxRetries,
+		eraseJobs:       make(map[string]*eraseJob),
+		cacheStats:      make(map[string]string),
+		// migrations may be interrupted by restart
+		migrationsPending: 1,
 	}
+	ctrl.recorder = util.NewEventRecorder(cli, "lvm-volume-manager", nodeName)
 	ctrl.store, ctrl.controller = cache.NewInformer(
 		&cache.ListWatch{
 			ListFunc: cache.ListFunc(func(opts metav1.ListOptions) (runtime.Object, error) {
@@ -67,39 +111,171 @@ func NewController(cli kubernetes.Interface, lvm LVManager, domainName, nodeName
 			DeleteFunc: ctrl.enqueuePVC,
 		},
 	)
+	ctrl.podController = ctrl.newPodInformer()
+	metrics.RegisterCollector(ctrl.collectVolumeStats)
 	return ctrl
 }
 
 func (c *Controller) Run(workers int, stopCh <-chan struct{}) {
 	defer utilruntime.HandleCrash()
-	defer c.queue.ShutDown()
 	glog.Infof("Starting LVM controller")
+	c.stopCh = stopCh
 	go c.controller.Run(stopCh)
+	go c.podController.Run(stopCh)
+	// a PVC missing from the store before it's synced would be released
+	if !cache.WaitForCacheSync(stopCh, c.controller.HasSynced) {
+		return
+	}
+	var wg sync.WaitGroup
 	for i := 0; i < workers; i++ {
-		go wait.Until(c.worker, time.Second, stopCh)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(c.worker, time.Second, stopCh)
+		}()
 	}
+	go wait.Until(c.reportCacheStats, cacheStatsInterval, stopCh)
+	go wait.Until(c.autoGrowVolumes, autoGrowInterval, stopCh)
+	go wait.Until(c.checkHealth, healthCheckInterval, stopCh)
+	go wait.Until(c.decommission, decommissionInterval, stopCh)
+	go wait.Until(c.syncVolumeMigrations, volumeMigrationInterval, stopCh)
 	<-stopCh
-	glog.Infof("Shutting down LVM controller")
+	glog.Infof("Shutting down LVM controller, waiting for in-flight syncs")
+	c.queue.ShutDown()
+	wg.Wait()
+	glog.Infof("LVM controller is shut down")
 }
 
 func (c *Controller) worker() {
-	for {
-		func() {
-			key, quit := c.queue.Get()
-			if quit {
-				return
-			}
-			defer c.queue.Done(key)
-			if err := c.syncPVC(key.(string)); err != nil {
-				glog.Error(err)
-			}
-			if err := c.lvm.SyncLVMStatus(); err != nil {
-				glog.Error(err)
-			}
-		}()
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+	select {
+	case <-c.stopCh:
+		// queued PVCs are synced again after restart, only in-flight syncs
+		// are drained
+		return false
+	default:
+	}
+	err := c.syncPVC(key.(string))
+	cmdErr, isCmdErr := err.(*CommandError)
+	switch {
+	case err == nil:
+		pvcSyncTotal.Inc("success")
+		c.queue.Forget(key)
+	case isCmdErr && (cmdErr.Reason == ReasonInsufficientSpace || cmdErr.Reason == ReasonVGNotFound):
+		// the VG can't hold the LV, let the scheduler select another one
+		pvcSyncTotal.Inc("reschedule")
+		glog.Errorf("failed to sync PVC %s, will reschedule: %v", key, err)
+		c.queue.Forget(key)
+		c.rollbackFailedPVC(key.(string))
+		c.reschedulePVC(key.(string), err)
+	case isCmdErr && !cmdErr.Retryable():
+		pvcSyncTotal.Inc("failed")
+		glog.Errorf("failed to sync PVC %s, giving up: %v", key, err)
+		c.queue.Forget(key)
+		c.rollbackFailedPVC(key.(string))
+		c.markPVCFailed(key.(string), err)
+	case c.queue.NumRequeues(key) < c.maxRetries:
+		pvcSyncTotal.Inc("retry")
+		glog.Errorf("failed to sync PVC %s, will retry: %v", key, err)
+		c.queue.AddRateLimited(key)
+	default:
+		pvcSyncTotal.Inc("failed")
+		glog.Errorf("failed to sync PVC %s after %d retries, giving up: %v", key, c.maxRetries, err)
+		c.queue.Forget(key)
+		c.rollbackFailedPVC(key.(string))
+		c.markPVCFailed(key.(string), err)
+	}
+	return true
+}
+
+// rollbackFailedPVC rolls back the unfinished intents of a PVC given up or
+// rescheduled, nothing is published before the PVC is updated so it's safe
+// to remove their LVs
+func (c *Controller) rollbackFailedPVC(key string) {
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return
+	}
+	intents, err := c.lvm.ListIntents()
+	if err != nil {
+		glog.Errorf("failed to list intents: %v", err)
+		return
+	}
+	obj, exists, _ := c.store.GetByKey(key)
+	pvc, _ := obj.(*v1.PersistentVolumeClaim)
+	for _, intent := range intents {
+		if intent.PVCNamespace != ns || intent.PVCName != name || intent.Reached(PhaseDone) {
+			continue
+		}
+		err := c.lvm.RollbackIntent(intent)
+		if err != nil {
+			glog.Errorf("failed to roll back LV %s/%s: %v", intent.VGName, intent.LVName, err)
+		}
+		if !exists || pvc == nil {
+			continue
+		}
+		if err != nil {
+			c.recordPVCEvent(pvc, v1.EventTypeWarning, "RollbackFailed", "failed to roll back LV %s/%s: %v", intent.VGName, intent.LVName, err)
+		} else {
+			c.recordPVCEvent(pvc, v1.EventTypeNormal, "RolledBack", "rolled back LV %s/%s", intent.VGName, intent.LVName)
+		}
 	}
 }
 
+// markPVCFailed records the error in the PVC annotation, the PVC won't be
+// synced again until the annotation is removed
+func (c *Controller) markPVCFailed(key string, syncErr error) {
+	obj, exists, err := c.store.GetByKey(key)
+	if err != nil || !exists {
+		glog.Errorf("PVC %s is gone, can't mark it as failed", key)
+		return
+	}
+	pvc := obj.(*v1.PersistentVolumeClaim).DeepCopy()
+	if pvc.Annotations == nil {
+		pvc.Annotations = map[string]string{}
+	}
+	pvc.Annotations[util.AnnProvisionerFailed] = syncErr.Error()
+	c.recordPVCEvent(pvc, v1.EventTypeWarning, "ProvisioningFailed", "give up: %v", syncErr)
+	if _, err := c.kubeCli.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(pvc); err != nil {
+		glog.Errorf("failed to mark PVC %s as failed: %v", key, err)
+	}
+}
+
+// reschedulePVC removes the node and VG selected by the scheduler from the
+// PVC so that they are selected again, it's only done before the LV is
+// published in the hostPath annotation
+func (c *Controller) reschedulePVC(key string, syncErr error) {
+	obj, exists, err := c.store.GetByKey(key)
+	if err != nil || !exists {
+		return
+	}
+	pvc := obj.(*v1.PersistentVolumeClaim).DeepCopy()
+	if pvc.Annotations[util.AnnProvisionerHostPath] != "" {
+		return
+	}
+	vgName := pvc.Annotations[util.AnnProvisionerVGName]
+	delete(pvc.Annotations, util.AnnProvisionerNode)
+	delete(pvc.Annotations, util.AnnProvisionerHostPath)
+	if pvc.Annotations[util.AnnProvisionerVGSelector] != "" {
+		// the VG is selected by the scheduler only with a selector
+		delete(pvc.Annotations, util.AnnProvisionerVGName)
+	}
+	if _, err := c.kubeCli.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(pvc); err != nil {
+		glog.Errorf("failed to reschedule PVC %s: %v", key, err)
+		return
+	}
+	c.recordPVCEvent(pvc, v1.EventTypeWarning, "Rescheduled", "rescheduled from VG %s on node %s: %v", vgName, c.nodeName, syncErr)
+}
+
 func (c *Controller) enqueuePVC(obj interface{}) {
 	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 	if err != nil {
@@ -135,6 +311,10 @@ func (c *Controller) syncPVC(key string) error {
 		glog.Infof("PVC %s/%s not scheduled or not managed by me", ns, pvcName)
 		return nil
 	}
+	if reason := ann[util.AnnProvisionerFailed]; reason != "" {
+		glog.Infof("PVC %s/%s is marked as failed: %s", ns, pvcName, reason)
+		return nil
+	}
 	hostPath, ok := ann[util.AnnProvisionerHostPath]
 	if !ok || hostPath != "" {
 		glog.Infof("PVC %s/%s doesn't contain hostPath annotation or already provisioned", ns, pvcName)
@@ -143,44 +323,178 @@ func (c *Controller) syncPVC(key string) error {
 
 	vgName := ann[util.AnnProvisionerVGName]
 	lvName := ann[util.AnnProvisionerLVName]
-	size := ann[util.AnnProvisionerLVSize]
-	// fsType := ann[util.AnnProvisionerLVFsType]
-	fsType := "ext4"
-	if err := c.lvm.AllocateLV(lvName, vgName, size); err != nil {
-		glog.Errorf("failed to allocate LV")
+	if selector := ann[util.AnnProvisionerVGSelector]; selector != "" {
+		vg, ok := c.lvm.VGs()[vgName]
+		if !ok || !util.MatchVGSelector(selector, vg.Tags) {
+			return fmt.Errorf("vg %s of PVC %s/%s doesn't match selector %s", vgName, ns, pvcName, selector)
+		}
+	}
+	layout, err := util.LVLayoutFromAnnotations(ann)
+	if err != nil {
+		return fmt.Errorf("invalid LV layout of PVC %s/%s: %v", ns, pvcName, err)
+	}
+	cache, err := util.CacheOptionsFromAnnotations(ann)
+	if err != nil {
+		return fmt.Errorf("invalid cache options of PVC %s/%s: %v", ns, pvcName, err)
+	}
+	erase, err := util.EraseOptionsFromAnnotations(ann)
+	if err != nil {
+		return fmt.Errorf("invalid erase options of PVC %s/%s: %v", ns, pvcName, err)
+	}
+	ownership, err := util.OwnershipOptionsFromAnnotations(ann)
+	if err != nil {
+		return fmt.Errorf("invalid ownership options of PVC %s/%s: %v", ns, pvcName, err)
+	}
+
+	intent, err := c.lvm.LoadIntent(lvName, vgName)
+	if err != nil {
 		return err
 	}
-	if err := c.lvm.FormatLV(lvName, vgName, fsType); err != nil {
+	if intent == nil && c.Decommissioning() {
+		c.reschedulePVC(key, fmt.Errorf("node %s is being decommissioned", c.nodeName))
+		return nil
+	}
+	if intent == nil {
+		_, existed := c.lvm.VGs()[vgName].LVs[lvName]
+		if err := c.lvm.VerifyLVReusable(lvName, vgName, string(pvc.UID)); err != nil {
+			return err
+		}
+		intent = &Intent{
+			PVCNamespace: ns,
+			PVCName:      pvcName,
+			PVCUID:       string(pvc.UID),
+			LVName:       lvName,
+			VGName:       vgName,
+			Created:      !existed,
+			Phase:        PhasePending,
+			StartTime:    time.Now(),
+		}
+		if err := c.lvm.SaveIntent(intent); err != nil {
+			return err
+		}
+	}
+	if intent.PVCNamespace != ns || intent.PVCName != pvcName || intent.PVCUID != string(pvc.UID) {
+		return fmt.Errorf("LV %s/%s is being provisioned for PVC %s/%s", vgName, lvName, intent.PVCNamespace, intent.PVCName)
+	}
+
+	hostPath, done, err := c.provisionLV(key, intent, pvc, layout, cache, erase, ownership)
+	if sigErr, ok := err.(*SignatureError); ok {
+		// keep the LV untouched until the user decides to force formatting it
+		c.recordPVCEvent(pvc, v1.EventTypeWarning, "FormatRefused",
+			"%v, set annotation %s=true to format it anyway", sigErr, util.AnnProvisionerForceFormat)
 		return err
 	}
-	hostPath, err = c.lvm.MountLV(lvName, vgName)
 	if err != nil {
+		// the retry resumes from the phase of the intent, it's rolled back
+		// once the PVC is given up or rescheduled
+		c.recordPVCEvent(pvc, v1.EventTypeWarning, "ProvisioningFailed", "failed to provision LV %s/%s: %v", vgName, lvName, err)
 		return err
 	}
+	if !done {
+		return nil
+	}
 	ann[util.AnnProvisionerHostPath] = hostPath
 	_, err = c.kubeCli.CoreV1().PersistentVolumeClaims(ns).Update(pvc)
 	if err != nil {
 		glog.Errorf("failed to update PVC %s/%s: %v", ns, pvcName, err)
 		return err
 	}
+	c.recordPVCEvent(pvc, v1.EventTypeNormal, "Provisioned", "LV %s/%s is ready at %s on node %s", vgName, lvName, hostPath, c.nodeName)
+	return c.lvm.AdvanceIntent(intent, PhaseDone)
+}
 
-	return nil
+// provisionLV runs the provisioning steps not finished by the intent yet,
+// it returns false if the LV is being erased in background
+func (c *Controller) provisionLV(key string, intent *Intent, pvc *v1.PersistentVolumeClaim,
+	layout util.LVLayout, cache *util.CacheOptions, erase util.EraseOptions, ownership util.OwnershipOptions) (string, bool, error) {
+	lvName, vgName := intent.LVName, intent.VGName
+	lvm := c.lvm.WithOperation(intent.operation("provision"))
+	ann := pvc.GetAnnotations()
+	// fsType := ann[util.AnnProvisionerLVFsType]
+	fsType := "ext4"
+	if !intent.Reached(PhaseAllocated) {
+		tags := util.LVOwnerTags(intent.PVCNamespace, intent.PVCName, intent.PVCUID)
+		if err := lvm.AllocateLV(lvName, vgName, ann[util.AnnProvisionerLVSize], layout, cache, tags); err != nil {
+			glog.Errorf("failed to allocate LV")
+			return "", false, err
+		}
+		c.recorder.Eventf(pvc, v1.EventTypeNormal, "LVCreated", "created %s LV %s/%s of size %s",
+			layout.Type, vgName, lvName, ann[util.AnnProvisionerLVSize])
+		if err := c.lvm.AdvanceIntent(intent, PhaseAllocated); err != nil {
+			return "", false, err
+		}
+	}
+	if !intent.Reached(PhaseErased) {
+		if erase.EraseOnCreate() {
+			erased, err := c.eraseLV(lvm, key, lvName, vgName, erase.Policy, c.reportPVCEraseProgress(intent.PVCNamespace, intent.PVCName))
+			if err != nil || !erased {
+				return "", false, err
+			}
+		}
+		if erase.EraseOnCreate() {
+			c.recorder.Eventf(pvc, v1.EventTypeNormal, "LVErased", "erased LV %s/%s with policy %s", vgName, lvName, erase.Policy)
+		}
+		if err := c.lvm.AdvanceIntent(intent, PhaseErased); err != nil {
+			return "", false, err
+		}
+	}
+	// the LUKS device is opened again after restart, so always run it
+	if encryption := util.EncryptionOptionsFromAnnotations(ann); encryption != nil {
+		key, err := c.encryptionKey(encryption, true)
+		if err != nil {
+			return "", false, err
+		}
+		if err := lvm.EncryptLV(lvName, vgName, key); err != nil {
+			return "", false, err
+		}
+	}
+	if !intent.Reached(PhaseEncrypted) {
+		if util.EncryptionOptionsFromAnnotations(ann) != nil {
+			c.recorder.Eventf(pvc, v1.EventTypeNormal, "LVEncrypted", "encrypted LV %s/%s with LUKS", vgName, lvName)
+		}
+		if err := c.lvm.AdvanceIntent(intent, PhaseEncrypted); err != nil {
+			return "", false, err
+		}
+	}
+	if !intent.Reached(PhaseFormatted) {
+		force := ann[util.AnnProvisionerForceFormat] == "true"
+		if err := lvm.FormatLV(lvName, vgName, fsType, force); err != nil {
+			return "", false, err
+		}
+		c.recorder.Eventf(pvc, v1.EventTypeNormal, "LVFormatted", "formatted LV %s/%s with %s", vgName, lvName, fsType)
+		if err := c.lvm.AdvanceIntent(intent, PhaseFormatted); err != nil {
+			return "", false, err
+		}
+	}
+	hostPath, err := lvm.MountLV(lvName, vgName)
+	if err != nil {
+		return "", false, err
+	}
+	if !intent.Reached(PhaseMounted) {
+		// set once before the volume is published, later changes made by
+		// the pods are kept
+		if err := lvm.SetOwnership(lvName, ownership); err != nil {
+			return "", false, err
+		}
+		c.recorder.Eventf(pvc, v1.EventTypeNormal, "LVMounted", "mounted LV %s/%s at %s", vgName, lvName, hostPath)
+		if err := c.lvm.AdvanceIntent(intent, PhaseMounted); err != nil {
+			return "", false, err
+		}
+	}
+	return hostPath, true, nil
 }
 
 func (c *Controller) UpdateNodeStatus(vgs map[string]VolumeGroup) error {
 	if len(vgs) == 0 {
 		return nil
 	}
-	vg, found := vgs["loopback-disk"]
-	if !found {
-		return nil
-	}
-	patches := []NodePatch{
-		{
+	var patches []NodePatch
+	for _, vg := range vgs {
+		patches = append(patches, NodePatch{
 			Op:    "add",
 			Path:  fmt.Sprintf("/status/capacity/%s~1%s", c.domainName, vg.Name),
 			Value: strings.ToUpper(vg.Size),
-		},
+		})
 	}
 	data, err := json.Marshal(patches)
 	if err != nil {
@@ -196,7 +510,225 @@ func (c *Controller) UpdateNodeStatus(vgs map[string]VolumeGroup) error {
 	return nil
 }
 
-func (c *Controller) ReleaseLV(pvcNamespace, pvcName string) error {
+// UpdateNodeVGs publishes the VGs and their tags in node annotation and labels
+// so that the scheduler can select VGs by tags
+func (c *Controller) UpdateNodeVGs(vgs map[string]VolumeGroup) error {
+	node, err := c.kubeCli.CoreV1().Nodes().Get(c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("failed to get node %s: %v", c.nodeName, err)
+		return err
+	}
+	infos := NodeVGInfos(vgs)
+	labels := map[string]interface{}{}
+	for _, info := range infos {
+		for _, tag := range info.Tags {
+			labels[util.VGTagLabel(c.domainName, tag)] = "true"
+		}
+	}
+	// remove labels of tiers this node doesn't offer any more
+	prefix := util.VGTagLabelPrefix(c.domainName)
+	for key := range node.GetLabels() {
+		if _, ok := labels[key]; !ok && strings.HasPrefix(key, prefix) {
+			labels[key] = nil
+		}
+	}
+	vgData, err := json.Marshal(infos)
+	if err != nil {
+		return err
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": map[string]string{util.AnnNodeVGs: string(vgData)},
+		},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		glog.Errorf("failed to marshal patch %v: %v", patch, err)
+		return err
+	}
+	_, err = c.kubeCli.CoreV1().Nodes().Patch(c.nodeName, types.MergePatchType, data)
+	if err != nil {
+		glog.Errorf("failed to patch VGs for node %s: %v", c.nodeName, err)
+		return err
+	}
+	return nil
+}
+
+// NodeVGInfos returns the summaries of the VGs published in the node
+// annotation, sorted by name so that unchanged VGs are published unchanged
+func NodeVGInfos(vgs map[string]VolumeGroup) []util.VGInfo {
+	infos := []util.VGInfo{}
+	for _, vg := range vgs {
+		info := vg.VGInfo()
+		sort.Slice(info.PVs, func(i, j int) bool { return info.PVs[i].Name < info.PVs[j].Name })
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// encryptionKey returns the LUKS key of an encrypted LV, a generated key is
+// created if it doesn't exist and create is true
+func (c *Controller) encryptionKey(opts *util.EncryptionOptions, create bool) ([]byte, error) {
+	secrets := c.kubeCli.CoreV1().Secrets(opts.SecretNamespace)
+	secret, err := secrets.Get(opts.SecretName, metav1.GetOptions{})
+	if err == nil {
+		key := secret.Data[util.EncryptionKeySecretKey]
+		if len(key) == 0 {
+			return nil, fmt.Errorf("secret %s/%s has no %s", opts.SecretNamespace, opts.SecretName, util.EncryptionKeySecretKey)
+		}
+		return key, nil
+	}
+	if !apierr.IsNotFound(err) || !opts.Generated || !create {
+		glog.Errorf("failed to get LUKS key secret %s/%s: %v", opts.SecretNamespace, opts.SecretName, err)
+		return nil, err
+	}
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	secret = &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: opts.SecretName},
+		Data:       map[string][]byte{util.EncryptionKeySecretKey: key},
+	}
+	if _, err := secrets.Create(secret); err != nil {
+		glog.Errorf("failed to create LUKS key secret %s/%s: %v", opts.SecretNamespace, opts.SecretName, err)
+		return nil, err
+	}
+	return key, nil
+}
+
+// ReopenEncryptedLVs opens and mounts the encrypted LVs of this node, which
+// are closed after the node restarts, the volumes failed to reopen are
+// reported by events on their PVs
+func (c *Controller) ReopenEncryptedLVs() error {
+	pvList, err := c.kubeCli.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list pv: %v", err)
+		return err
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		ann := pv.GetAnnotations()
+		if ann[util.AnnProvisionerNode] != c.nodeName || ann[util.AnnProvisionerLVDeleted] == "true" {
+			continue
+		}
+		encryption := util.EncryptionOptionsFromAnnotations(ann)
+		if encryption == nil {
+			continue
+		}
+		lvName := ann[util.AnnProvisionerLVName]
+		vgName := ann[util.AnnProvisionerVGName]
+		// a volume failed to reopen doesn't keep the others unmanaged
+		if err := c.reopenEncryptedLV(pv, lvName, vgName, encryption); err != nil {
+			glog.Errorf("failed to reopen encrypted LV %s/%s of PV %s: %v", vgName, lvName, pv.Name, err)
+			c.recorder.Eventf(pv, v1.EventTypeWarning, "LVReopenFailed", "failed to reopen encrypted LV %s/%s: %v", vgName, lvName, err)
+			continue
+		}
+		glog.Infof("reopened encrypted LV %s of PV %s", lvName, pv.GetName())
+	}
+	return nil
+}
+
+func (c *Controller) reopenEncryptedLV(pv *v1.PersistentVolume, lvName, vgName string, encryption *util.EncryptionOptions) error {
+	key, err := c.encryptionKey(encryption, false)
+	if err != nil {
+		return err
+	}
+	lvm := c.lvm.WithOperation(Operation{Trigger: "reopen", PVName: pv.GetName(), VGName: vgName, LVName: lvName})
+	if err := lvm.OpenEncryptedLV(lvName, vgName, key); err != nil {
+		return err
+	}
+	_, err = lvm.MountLV(lvName, vgName)
+	return err
+}
+
+// reportCacheStats records the cache statistics of cached LVs on this node
+// in the annotations of their PVs, the PVs are only patched once the
+// statistics change
+func (c *Controller) reportCacheStats() {
+	cached := map[string]bool{}
+	for _, vg := range c.lvm.VGs() {
+		for _, lv := range vg.LVs {
+			if lv.SegType == "cache" {
+				cached[vg.Name+"/"+lv.Name] = true
+			}
+		}
+	}
+	seen := map[string]bool{}
+	defer func() {
+		for pvName := range c.cacheStats {
+			if !seen[pvName] {
+				delete(c.cacheStats, pvName)
+			}
+		}
+	}()
+	for _, obj := range c.store.List() {
+		pvc, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			continue
+		}
+		ann := pvc.GetAnnotations()
+		lvName, vgName, pvName := ann[util.AnnProvisionerLVName], ann[util.AnnProvisionerVGName], pvc.Spec.VolumeName
+		if ann[util.AnnProvisionerNode] != c.nodeName || pvName == "" || !cached[vgName+"/"+lvName] {
+			continue
+		}
+		seen[pvName] = true
+		stats, err := c.lvm.CacheStats(lvName, vgName)
+		if err != nil {
+			continue
+		}
+		data, err := json.Marshal(stats)
+		if err != nil {
+			continue
+		}
+		reported, ok := c.cacheStats[pvName]
+		if !ok {
+			pv, err := c.kubeCli.CoreV1().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+			if err != nil {
+				glog.Errorf("failed to get PV %s: %v", pvName, err)
+				continue
+			}
+			reported = pv.Annotations[util.AnnProvisionerCacheStats]
+		}
+		if reported != string(data) {
+			patch, err := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{util.AnnProvisionerCacheStats: string(data)},
+				},
+			})
+			if err != nil {
+				continue
+			}
+			if _, err := c.kubeCli.CoreV1().PersistentVolumes().Patch(pvName, types.MergePatchType, patch); err != nil {
+				glog.Errorf("failed to update cache stats of PV %s: %v", pvName, err)
+				continue
+			}
+		}
+		c.cacheStats[pvName] = string(data)
+	}
+}
+
+// rollbackPVCIntents rolls back the LVs of a deleted PVC which has not been
+// bound to a PV yet
+func (c *Controller) rollbackPVCIntents(ns, pvcName string) error {
+	intents, err := c.lvm.ListIntents()
+	if err != nil {
+		return err
+	}
+	for _, intent := range intents {
+		if intent.PVCNamespace != ns || intent.PVCName != pvcName {
+			continue
+		}
+		if err := c.lvm.RollbackIntent(intent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Controller) ReleaseLV(pvcNamespace, pvcName string) (err error) {
 	opts := metav1.ListOptions{}
 	pvList, err := c.kubeCli.CoreV1().PersistentVolumes().List(opts)
 	if err != nil {
@@ -206,29 +738,80 @@ func (c *Controller) ReleaseLV(pvcNamespace, pvcName string) error {
 	var pv *v1.PersistentVolume
 	for _, item := range pvList.Items {
 		ref := item.Spec.ClaimRef
-		if ref != nil && ref.Namespace == pvcNamespace && ref.Name == pvcName {
+		// a migrated PVC has PVs on both nodes until it's recreated
+		if ref != nil && ref.Namespace == pvcNamespace && ref.Name == pvcName &&
+			item.Annotations[util.AnnProvisionerNode] == c.nodeName {
 			pv = &item
 			break
 		}
 	}
 	if pv == nil {
 		glog.Infof("no pv found for pvc %s/%s", pvcNamespace, pvcName)
-		return nil
+		return c.rollbackPVCIntents(pvcNamespace, pvcName)
 	}
 	pvName := pv.GetName()
 	ann := pv.GetAnnotations()
-	if node := ann[util.AnnProvisionerNode]; node != c.nodeName {
-		glog.Infof("pv %s not managed by me", pvName)
+	if ann[util.AnnProvisionerImported] == "true" {
+		glog.Infof("pv %s is imported, keep its LV", pvName)
 		return nil
 	}
 	lvName := ann[util.AnnProvisionerLVName]
 	vgName := ann[util.AnnProvisionerVGName]
-	if err := c.lvm.UnmountLV(lvName); err != nil {
+	lvm := c.lvm.WithOperation(Operation{
+		Trigger:      "pvc-deleted",
+		PVCNamespace: pvcNamespace,
+		PVCName:      pvcName,
+		PVName:       pvName,
+		VGName:       vgName,
+		LVName:       lvName,
+	})
+	defer func() {
+		if err != nil {
+			c.recorder.Eventf(pv, v1.EventTypeWarning, "LVRemoveFailed", "failed to remove LV %s/%s: %v", vgName, lvName, err)
+		}
+	}()
+	if err := c.lvm.VerifyLVOwner(lvName, vgName, string(pv.Spec.ClaimRef.UID)); err != nil {
+		return err
+	}
+	if err := lvm.UnmountLV(lvName); err != nil {
 		return err
 	}
-	if err := c.lvm.RemoveLV(lvName, vgName); err != nil {
+	encryption := util.EncryptionOptionsFromAnnotations(ann)
+	if encryption != nil {
+		if err := lvm.CloseEncryptedLV(lvName, vgName); err != nil {
+			return err
+		}
+		if c.lvm.IsEncrypted(lvName, vgName) {
+			if err := lvm.EraseEncryptedLV(lvName, vgName); err != nil {
+				return err
+			}
+		}
+	}
+	erase, err := util.EraseOptionsFromAnnotations(ann)
+	if err != nil {
+		return fmt.Errorf("invalid erase options of PV %s: %v", pvName, err)
+	}
+	if erase.EraseOnDelete() {
+		// the LV is kept until erased so that its capacity can't be reused
+		key := pvcNamespace + "/" + pvcName
+		erased, err := c.eraseLV(lvm, key, lvName, vgName, erase.Policy, c.reportPVEraseProgress(pvName))
+		if err != nil || !erased {
+			return err
+		}
+	}
+	if err := lvm.RemoveLV(lvName, vgName); err != nil {
 		return err
 	}
+	c.recorder.Eventf(pv, v1.EventTypeNormal, "LVRemoved", "removed LV %s/%s", vgName, lvName)
+	if err := c.lvm.DeleteIntent(lvName, vgName); err != nil {
+		glog.Errorf("failed to delete intent of LV %s/%s: %v", vgName, lvName, err)
+	}
+	if encryption != nil && encryption.Generated {
+		err := c.kubeCli.CoreV1().Secrets(encryption.SecretNamespace).Delete(encryption.SecretName, &metav1.DeleteOptions{})
+		if err != nil && !apierr.IsNotFound(err) {
+			glog.Errorf("failed to delete LUKS key secret %s/%s: %v", encryption.SecretNamespace, encryption.SecretName, err)
+		}
+	}
 	return wait.Poll(3*time.Second, 30*time.Second, func() (bool, error) {
 		pv.Annotations[util.AnnProvisionerLVDeleted] = "true"
 		_, err = c.kubeCli.CoreV1().PersistentVolumes().Update(pv)
@@ -247,3 +830,11 @@ func (c *Controller) ReleaseLV(pvcNamespace, pvcName string) error {
 		return false, nil
 	})
 }
+
+// recordPVCEvent records the event on the PVC and the pod it's scheduled for
+func (c *Controller) recordPVCEvent(pvc *v1.PersistentVolumeClaim, eventtype, reason, messageFmt string, args ...interface{}) {
+	c.recorder.Eventf(pvc, eventtype, reason, messageFmt, args...)
+	if pod := util.PodReference(pvc); pod != nil {
+		c.recorder.Eventf(pod, eventtype, reason, messageFmt, args...)
+	}
+}
@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+// EncryptLV formats the LV as a LUKS device unless it already is one, then
+// opens it so that the filesystem is created on the mapper device
+func (m *LVManager) EncryptLV(lvName, vgName string, key []byte) error {
+	devPath := getDevPath(lvName, vgName)
+	if !m.IsEncrypted(lvName, vgName) {
+		output, err := m.runAudited(key, "cryptsetup", "luksFormat", "--batch-mode", "--key-file", "-", devPath)
+		if err != nil {
+			glog.Errorf("failed to luksFormat LV %s: %v", devPath, err)
+			return err
+		}
+		glog.Infof("cryptsetup luksFormat output: %s", output)
+	}
+	return m.OpenEncryptedLV(lvName, vgName, key)
+}
+
+// OpenEncryptedLV opens the LUKS device of the LV if it's not opened yet
+func (m *LVManager) OpenEncryptedLV(lvName, vgName string, key []byte) error {
+	if isCryptOpened(lvName, vgName) {
+		return nil
+	}
+	devPath := getDevPath(lvName, vgName)
+	output, err := m.runAudited(key, "cryptsetup", "luksOpen", "--key-file", "-", devPath, cryptName(lvName, vgName))
+	if err != nil {
+		glog.Errorf("failed to luksOpen LV %s: %v", devPath, err)
+		return err
+	}
+	glog.Infof("cryptsetup luksOpen output: %s", output)
+	return nil
+}
+
+// CloseEncryptedLV closes the LUKS device of the LV if it's opened
+func (m *LVManager) CloseEncryptedLV(lvName, vgName string) error {
+	if !isCryptOpened(lvName, vgName) {
+		return nil
+	}
+	output, err := m.runAudited(nil, "cryptsetup", "luksClose", cryptName(lvName, vgName))
+	if err != nil {
+		glog.Errorf("failed to luksClose LV %s: %v", lvName, err)
+		return err
+	}
+	glog.Infof("cryptsetup luksClose output: %s", output)
+	return nil
+}
+
+// EraseEncryptedLV destroys all key slots and wipes the LUKS header so the
+// data can never be decrypted again
+func (m *LVManager) EraseEncryptedLV(lvName, vgName string) error {
+	devPath := getDevPath(lvName, vgName)
+	output, err := m.runAudited(nil, "cryptsetup", "erase", "--batch-mode", devPath)
+	if err != nil {
+		glog.Errorf("failed to erase LUKS key slots of LV %s: %v", devPath, err)
+		return err
+	}
+	glog.Infof("cryptsetup erase output: %s", output)
+	output, err = m.runAudited(nil, "wipefs", "--all", devPath)
+	if err != nil {
+		glog.Errorf("failed to wipe LUKS header of LV %s: %v", devPath, err)
+		return err
+	}
+	glog.Infof("wipefs output: %s", output)
+	return nil
+}
+
+// IsEncrypted reports whether the LV is a LUKS device
+func (m *LVManager) IsEncrypted(lvName, vgName string) bool {
+	_, err := runCommand(nil, "cryptsetup", "isLuks", getDevPath(lvName, vgName))
+	return err == nil
+}
+
+func cryptName(lvName, vgName string) string {
+	return path.Base(getDevPath(lvName, vgName)) + "-crypt"
+}
+
+func isCryptOpened(lvName, vgName string) bool {
+	_, err := os.Stat(path.Join("/dev/mapper", cryptName(lvName, vgName)))
+	return err == nil
+}
+
+// getVolumePath returns the device holding the filesystem of the LV, which
+// is the LUKS mapper device for an opened encrypted LV
+func getVolumePath(lvName, vgName string) string {
+	if isCryptOpened(lvName, vgName) {
+		return path.Join("/dev/mapper", cryptName(lvName, vgName))
+	}
+	return getDevPath(lvName, vgName)
+}
@@ -0,0 +1,253 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const decommissionInterval = 30 * time.Second
+
+// phases of decommissioning a node
+const (
+	// DecommissionDraining waits for the owners to migrate or delete the PVCs
+	DecommissionDraining = "Draining"
+	// DecommissionMigrating copies the volumes to the target node
+	DecommissionMigrating = "Migrating"
+	// DecommissionCleaningUp removes the VGs once no volume is left
+	DecommissionCleaningUp = "CleaningUp"
+	DecommissionDone       = "Done"
+)
+
+// DecommissionStatus is the progress of decommissioning the node published
+// in the node annotation
+type DecommissionStatus struct {
+	Phase  string `json:"phase"`
+	Target string `json:"target,omitempty"`
+	// Volumes are the PVCs, or the PVs without claims, left on the node
+	Volumes []string  `json:"volumes,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Decommissioning reports whether the node is being decommissioned, no LV
+// is created for new PVCs and the disks are not discovered any more
+func (c *Controller) Decommissioning() bool {
+	return atomic.LoadInt32(&c.decommissioning) == 1
+}
+
+// decommission moves the volumes off the node once it's annotated to be
+// decommissioned, then removes the VGs. The PVs are not listed unless the
+// node is decommissioned or migrations from it are unfinished.
+func (c *Controller) decommission() {
+	node, err := c.kubeCli.CoreV1().Nodes().Get(c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("failed to get node %s: %v", c.nodeName, err)
+		return
+	}
+	decommissioning := util.NodeDecommissioning(node)
+	if !decommissioning {
+		atomic.StoreInt32(&c.decommissioning, 0)
+		if atomic.LoadInt32(&c.migrationsPending) == 0 {
+			return
+		}
+	}
+	pvs, err := c.kubeCli.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list PVs: %v", err)
+		return
+	}
+	c.resumeMigrations(pvs.Items)
+	if !decommissioning {
+		return
+	}
+	if atomic.SwapInt32(&c.decommissioning, 1) == 0 {
+		glog.Infof("node %s is being decommissioned", c.nodeName)
+	}
+	var status DecommissionStatus
+	if data := node.Annotations[util.AnnNodeDecommissionStatus]; data != "" {
+		if err := json.Unmarshal([]byte(data), &status); err != nil {
+			glog.Errorf("invalid decommission status %s: %v", data, err)
+		}
+	}
+	if status.Phase == DecommissionDone {
+		return
+	}
+	next := c.decommissionStep(node, pvs.Items)
+	glog.Infof("decommission of node %s: %s %v %s", c.nodeName, next.Phase, next.Volumes, next.Message)
+	next.Time = time.Now()
+	data, err := json.Marshal(next)
+	if err != nil {
+		glog.Errorf("failed to marshal decommission status %+v: %v", next, err)
+		return
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{util.AnnNodeDecommissionStatus: string(data)},
+		},
+	})
+	if err != nil {
+		glog.Errorf("failed to marshal patch: %v", err)
+		return
+	}
+	if _, err := c.kubeCli.CoreV1().Nodes().Patch(c.nodeName, types.MergePatchType, patch); err != nil {
+		glog.Errorf("failed to update decommission status of node %s: %v", c.nodeName, err)
+	}
+}
+
+func (c *Controller) decommissionStep(node *v1.Node, pvs []v1.PersistentVolume) DecommissionStatus {
+	target := node.Annotations[util.AnnNodeDecommissionTarget]
+	status := DecommissionStatus{Target: target}
+	var messages []string
+	migrating := c.activeVolumeMigrations()
+	// PVCs being provisioned are finished, new ones are rescheduled by sync
+	for _, obj := range c.store.List() {
+		pvc, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			continue
+		}
+		ann := pvc.GetAnnotations()
+		if ann[util.AnnProvisionerNode] == c.nodeName && ann[util.AnnProvisionerHostPath] == "" {
+			status.Volumes = append(status.Volumes, pvc.Namespace+"/"+pvc.Name)
+		}
+	}
+	for _, pv := range pvs {
+		ann := pv.GetAnnotations()
+		if ann[util.AnnProvisionerNode] != c.nodeName || ann[util.AnnProvisionerLVDeleted] == "true" {
+			continue
+		}
+		ref := pv.Spec.ClaimRef
+		if ref == nil || pv.Status.Phase != v1.VolumeBound {
+			status.Volumes = append(status.Volumes, "pv/"+pv.Name)
+			continue
+		}
+		key := ref.Namespace + "/" + ref.Name
+		if migrating[key] {
+			// the VolumeMigration gives up the copy or rebinds the PVC first
+			messages = append(messages, fmt.Sprintf("waiting for volume migration of PVC %s", key))
+			status.Volumes = append(status.Volumes, key)
+			continue
+		}
+		obj, exists, err := c.store.GetByKey(key)
+		if target == "" || err != nil || !exists {
+			status.Volumes = append(status.Volumes, key)
+			continue
+		}
+		waiting, err := c.migratePVC(obj.(*v1.PersistentVolumeClaim), target)
+		switch {
+		case err != nil:
+			glog.Errorf("failed to migrate PVC %s to node %s: %v", key, target, err)
+			messages = append(messages, fmt.Sprintf("%s: %v", key, err))
+		case waiting != "":
+			messages = append(messages, waiting)
+		default:
+			// the PV is replaced by the one on the target node
+			continue
+		}
+		status.Volumes = append(status.Volumes, key)
+	}
+	sort.Strings(status.Volumes)
+	if len(status.Volumes) > 0 {
+		status.Phase = DecommissionMigrating
+		status.Message = strings.Join(messages, "; ")
+		if target == "" {
+			status.Phase = DecommissionDraining
+			status.Message = "waiting for the owners to migrate or delete the volumes"
+		}
+		return status
+	}
+	if err := c.removeVGs(node); err != nil {
+		status.Phase = DecommissionCleaningUp
+		status.Message = err.Error()
+		return status
+	}
+	status.Phase = DecommissionDone
+	status.Message = "all volumes are moved off and the VGs are removed"
+	return status
+}
+
+// removeVGs removes the VGs published by the manager and unpublishes them
+func (c *Controller) removeVGs(node *v1.Node) error {
+	infos, err := util.NodeVGs(node)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		vg, ok := c.lvm.VGs()[info.Name]
+		if !ok {
+			continue
+		}
+		if len(vg.LVs) > 0 {
+			var names []string
+			for name := range vg.LVs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("VG %s still has LVs %s not used by any PV, remove them manually", vg.Name, strings.Join(names, ","))
+		}
+		lvm := c.lvm.WithOperation(Operation{Trigger: "decommission", VGName: vg.Name})
+		if err := lvm.RemoveVG(vg.Name); err != nil {
+			return err
+		}
+	}
+	if err := c.UpdateNodeVGs(map[string]VolumeGroup{}); err != nil {
+		return err
+	}
+	var patches []NodePatch
+	for _, info := range infos {
+		resource := v1.ResourceName(fmt.Sprintf("%s/%s", c.domainName, info.Name))
+		if _, ok := node.Status.Capacity[resource]; ok {
+			patches = append(patches, NodePatch{
+				Op:   "remove",
+				Path: fmt.Sprintf("/status/capacity/%s~1%s", c.domainName, info.Name),
+			})
+		}
+	}
+	if len(patches) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(patches)
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeCli.CoreV1().Nodes().Patch(c.nodeName, types.JSONPatchType, data, "status")
+	return err
+}
+
+// RemoveVG removes the VG and the PV labels of its devices
+func (m *LVManager) RemoveVG(vgName string) error {
+	unlock, err := m.lockVG(vgName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer m.Inventory.Invalidate()
+	vg, ok := m.VGs()[vgName]
+	if !ok {
+		return nil
+	}
+	output, err := m.runLVMAudited("vgremove", vgName)
+	if err != nil {
+		glog.Errorf("failed to remove VG %s: %v", vgName, err)
+		return err
+	}
+	glog.Infof("vgremove output: %s", output)
+	for name := range vg.PVs {
+		output, err := m.runLVMAudited("pvremove", name)
+		if err != nil {
+			glog.Errorf("failed to remove PV %s: %v", name, err)
+			return err
+		}
+		glog.Infof("pvremove output: %s", output)
+	}
+	return nil
+}
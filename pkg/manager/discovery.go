@@ -0,0 +1,274 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	byIDDir         = "/dev/disk/by-id"
+	sysBlockDir     = "/sys/class/block"
+	discoveryRecord = "discovery.log"
+)
+
+// DiscoveryPlan is the set of devices that will be added to one VG
+type DiscoveryPlan struct {
+	VGName  string   `json:"vgName"`
+	Create  bool     `json:"create"`
+	Tags    []string `json:"tags,omitempty"`
+	Devices []string `json:"devices"`
+}
+
+func (p DiscoveryPlan) String() string {
+	action := "vgextend"
+	if p.Create {
+		action = "vgcreate"
+	}
+	return fmt.Sprintf("%s %s %s", action, p.VGName, strings.Join(p.Devices, " "))
+}
+
+type discoveryRecordEntry struct {
+	Time  time.Time     `json:"time"`
+	Plan  DiscoveryPlan `json:"plan"`
+	Error string        `json:"error,omitempty"`
+}
+
+// PlanDiscovery finds unused block devices matching the rules and returns
+// what needs to be done to put them into their VGs, nothing is changed.
+func (m *LVManager) PlanDiscovery(rules []DiscoveryRule) ([]DiscoveryPlan, error) {
+	report, err := scanLVM()
+	if err != nil {
+		return nil, err
+	}
+	usedDevs := map[string]bool{}
+	existingVGs := map[string]bool{}
+	for _, lvm := range report.Report {
+		for _, pv := range lvm.PV {
+			usedDevs[resolveDevice(pv.PVName)] = true
+		}
+		for _, vg := range lvm.VG {
+			existingVGs[vg.VGName] = true
+		}
+	}
+
+	var plans []DiscoveryPlan
+	for _, rule := range rules {
+		if rule.VGName == "" {
+			return nil, fmt.Errorf("discovery rule %+v has no vgName", rule)
+		}
+		var minSize int64
+		if rule.MinSize != "" {
+			q, err := resource.ParseQuantity(rule.MinSize)
+			if err != nil {
+				return nil, fmt.Errorf("invalid minSize %s of vg %s: %v", rule.MinSize, rule.VGName, err)
+			}
+			minSize = q.Value()
+		}
+		candidates, err := matchDevices(rule)
+		if err != nil {
+			return nil, err
+		}
+		plan := DiscoveryPlan{
+			VGName: rule.VGName,
+			Create: !existingVGs[rule.VGName],
+			Tags:   rule.VGTags,
+		}
+		for _, dev := range candidates {
+			if usedDevs[dev] {
+				continue
+			}
+			size, err := deviceSize(dev)
+			if err != nil {
+				glog.Errorf("failed to get size of device %s: %v", dev, err)
+				continue
+			}
+			if size < minSize {
+				glog.Infof("device %s is smaller than %s, skip it", dev, rule.MinSize)
+				continue
+			}
+			if ok, reason := deviceUnused(dev); !ok {
+				glog.Infof("device %s is in use: %s, skip it", dev, reason)
+				continue
+			}
+			// a device may only match one rule
+			usedDevs[dev] = true
+			plan.Devices = append(plan.Devices, dev)
+		}
+		if len(plan.Devices) == 0 {
+			continue
+		}
+		existingVGs[rule.VGName] = true
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// ApplyDiscovery runs pvcreate and vgcreate/vgextend for each plan and
+// records the result in the state directory.
+func (m *LVManager) ApplyDiscovery(plans []DiscoveryPlan) error {
+	defer m.Inventory.Invalidate()
+	for _, plan := range plans {
+		unlock, err := m.lockVG(plan.VGName)
+		if err != nil {
+			return err
+		}
+		lvm := m.WithOperation(Operation{Trigger: "discovery", VGName: plan.VGName})
+		err = lvm.applyDiscoveryPlan(plan)
+		unlock()
+		m.recordDiscovery(plan, err)
+		if err != nil {
+			return err
+		}
+		glog.Infof("discovery: %s", plan)
+	}
+	return nil
+}
+
+func (m *LVManager) applyDiscoveryPlan(plan DiscoveryPlan) error {
+	for _, dev := range plan.Devices {
+		output, err := m.runLVMAudited("pvcreate", dev)
+		if err != nil {
+			glog.Errorf("failed to create PV %s: %v", dev, err)
+			return err
+		}
+		glog.Infof("pvcreate output: %s", output)
+	}
+	var args []string
+	if plan.Create {
+		args = append(args, "vgcreate")
+		for _, tag := range plan.Tags {
+			args = append(args, "--addtag", tag)
+		}
+	} else {
+		args = append(args, "vgextend")
+	}
+	args = append(args, plan.VGName)
+	args = append(args, plan.Devices...)
+	output, err := m.runLVMAudited(args[0], args[1:]...)
+	if err != nil {
+		glog.Errorf("failed to %s: %v", plan, err)
+		return err
+	}
+	glog.Infof("%s output: %s", args[0], output)
+	return nil
+}
+
+func (m *LVManager) recordDiscovery(plan DiscoveryPlan, err error) {
+	if m.StateDir == "" {
+		return
+	}
+	entry := discoveryRecordEntry{Time: time.Now(), Plan: plan}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		glog.Errorf("failed to marshal discovery record %+v: %v", entry, err)
+		return
+	}
+	if err := os.MkdirAll(m.StateDir, 0755); err != nil {
+		glog.Errorf("failed to create state directory %s: %v", m.StateDir, err)
+		return
+	}
+	file := path.Join(m.StateDir, discoveryRecord)
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		glog.Errorf("failed to open %s: %v", file, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		glog.Errorf("failed to write %s: %v", file, err)
+	}
+}
+
+func matchDevices(rule DiscoveryRule) ([]string, error) {
+	patterns := append([]string{}, rule.DevicePaths...)
+	for _, p := range rule.ByIDPatterns {
+		patterns = append(patterns, path.Join(byIDDir, p))
+	}
+	seen := map[string]bool{}
+	var devs []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device pattern %s: %v", pattern, err)
+		}
+		for _, match := range matches {
+			dev := resolveDevice(match)
+			if seen[dev] {
+				continue
+			}
+			seen[dev] = true
+			info, err := os.Stat(dev)
+			if err != nil || info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+				continue
+			}
+			devs = append(devs, dev)
+		}
+	}
+	sort.Strings(devs)
+	return devs, nil
+}
+
+func resolveDevice(dev string) string {
+	resolved, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return dev
+	}
+	return resolved
+}
+
+func deviceSize(dev string) (int64, error) {
+	data, err := ioutil.ReadFile(path.Join(sysBlockDir, path.Base(dev), "size"))
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return sectors * 512, nil
+}
+
+// deviceUnused reports whether the device carries no partitions, holders or
+// any signature (filesystem, partition table, RAID member...)
+func deviceUnused(dev string) (bool, string) {
+	sysDir := path.Join(sysBlockDir, path.Base(dev))
+	holders, err := ioutil.ReadDir(path.Join(sysDir, "holders"))
+	if err != nil {
+		return false, fmt.Sprintf("can't read holders: %v", err)
+	}
+	if len(holders) > 0 {
+		return false, "device has holders"
+	}
+	entries, err := ioutil.ReadDir(sysDir)
+	if err != nil {
+		return false, fmt.Sprintf("can't read %s: %v", sysDir, err)
+	}
+	for _, entry := range entries {
+		if _, err := os.Stat(path.Join(sysDir, entry.Name(), "partition")); err == nil {
+			return false, "device has partitions"
+		}
+	}
+	output, err := runCommand(nil, "blkid", "--probe", "--output", "export", dev)
+	if err == nil {
+		return false, fmt.Sprintf("device has signature %s", strings.Replace(strings.TrimSpace(string(output)), "\n", ",", -1))
+	}
+	// blkid exits with 2 when no signature is found on the device
+	if exitCode(err) != 2 {
+		return false, fmt.Sprintf("can't probe signatures: %v", err)
+	}
+	return true, ""
+}
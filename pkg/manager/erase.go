@@ -0,0 +1,195 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	zeroHeaderSize = 1 << 20
+	overwriteChunk = 4 << 20
+)
+
+// EraseLV erases the blocks of the LV with the policy, progress is called
+// with the finished percentage
+func (m *LVManager) EraseLV(lvName, vgName, policy string, progress func(int)) error {
+	devPath := getDevPath(lvName, vgName)
+	switch policy {
+	case util.ErasePolicyNone:
+	case util.ErasePolicyDiscard:
+		output, err := m.runAudited(nil, "blkdiscard", devPath)
+		if err != nil {
+			glog.Errorf("failed to discard LV %s: %v", devPath, err)
+			return err
+		}
+		glog.Infof("blkdiscard output: %s", output)
+	case util.ErasePolicyZeroHeader:
+		start := time.Now()
+		err := zeroDevice(devPath, zeroHeaderSize, nil)
+		m.audit("zero", []string{"--size", strconv.Itoa(zeroHeaderSize), devPath}, start, err)
+		if err != nil {
+			return err
+		}
+	case util.ErasePolicyOverwrite:
+		start := time.Now()
+		err := zeroDevice(devPath, -1, progress)
+		m.audit("zero", []string{devPath}, start, err)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported erase policy %s", policy)
+	}
+	progress(100)
+	return nil
+}
+
+// zeroDevice writes zeros to the first limit bytes of the device, or the
+// whole device if limit is negative
+func zeroDevice(devPath string, limit int64, progress func(int)) error {
+	f, err := os.OpenFile(devPath, os.O_WRONLY, 0)
+	if err != nil {
+		glog.Errorf("failed to open %s: %v", devPath, err)
+		return err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if limit >= 0 && limit < size {
+		size = limit
+	}
+	buf := make([]byte, overwriteChunk)
+	var written int64
+	reported := 0
+	for written < size {
+		n := int64(len(buf))
+		if size-written < n {
+			n = size - written
+		}
+		if _, err := f.Write(buf[:n]); err != nil {
+			glog.Errorf("failed to zero %s at offset %d: %v", devPath, written, err)
+			return err
+		}
+		written += n
+		// report every 10 percent
+		if percent := int(written * 100 / size); progress != nil && percent/10 > reported/10 {
+			reported = percent
+			progress(percent)
+		}
+	}
+	return f.Sync()
+}
+
+type eraseJob struct {
+	finished bool
+	err      error
+}
+
+// eraseLV returns true once the LV has been erased. The erasure runs in
+// background and the key is requeued when it finishes.
+func (c *Controller) eraseLV(lvm *LVManager, key, lvName, vgName, policy string, report func(int)) (bool, error) {
+	c.eraseLock.Lock()
+	defer c.eraseLock.Unlock()
+	id := vgName + "/" + lvName
+	job, ok := c.eraseJobs[id]
+	if !ok {
+		job = &eraseJob{}
+		c.eraseJobs[id] = job
+		glog.Infof("start erasing LV %s with policy %s", id, policy)
+		go func() {
+			err := lvm.EraseLV(lvName, vgName, policy, func(percent int) {
+				glog.Infof("erasing LV %s: %d%%", id, percent)
+				report(percent)
+			})
+			c.eraseLock.Lock()
+			job.finished = true
+			job.err = err
+			c.eraseLock.Unlock()
+			c.queue.Add(key)
+		}()
+		return false, nil
+	}
+	if !job.finished {
+		return false, nil
+	}
+	// a failed erasure is started over on next sync
+	delete(c.eraseJobs, id)
+	if job.err != nil {
+		return false, fmt.Errorf("failed to erase LV %s: %v", id, job.err)
+	}
+	return true, nil
+}
+
+// ResumeReleases requeues the deleted PVCs whose LVs are not removed yet,
+// e.g. the manager restarted while erasing them, the erasure is started over
+// and the LVs are removed so that their capacity is not leaked
+func (c *Controller) ResumeReleases() error {
+	pvList, err := c.kubeCli.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list pv: %v", err)
+		return err
+	}
+	pvcList, err := c.kubeCli.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("failed to list pvc: %v", err)
+		return err
+	}
+	claims := map[string]bool{}
+	for _, pvc := range pvcList.Items {
+		claims[pvc.Namespace+"/"+pvc.Name] = true
+	}
+	for _, pv := range pvList.Items {
+		ann, ref := pv.GetAnnotations(), pv.Spec.ClaimRef
+		if ann[util.AnnProvisionerNode] != c.nodeName || ann[util.AnnProvisionerLVDeleted] == "true" ||
+			ann[util.AnnProvisionerImported] == "true" || ref == nil {
+			continue
+		}
+		key := ref.Namespace + "/" + ref.Name
+		if claims[key] {
+			continue
+		}
+		glog.Infof("resuming release of LV %s/%s of deleted PVC %s", ann[util.AnnProvisionerVGName], ann[util.AnnProvisionerLVName], key)
+		c.queue.Add(key)
+	}
+	return nil
+}
+
+func (c *Controller) reportPVEraseProgress(pvName string) func(int) {
+	return func(percent int) {
+		pv, err := c.kubeCli.CoreV1().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+		if err != nil {
+			glog.Errorf("failed to get PV %s: %v", pvName, err)
+			return
+		}
+		pv.Annotations[util.AnnProvisionerEraseProgress] = fmt.Sprintf("%d%%", percent)
+		if _, err := c.kubeCli.CoreV1().PersistentVolumes().Update(pv); err != nil {
+			glog.Errorf("failed to update erase progress of PV %s: %v", pvName, err)
+		}
+	}
+}
+
+func (c *Controller) reportPVCEraseProgress(ns, pvcName string) func(int) {
+	return func(percent int) {
+		pvc, err := c.kubeCli.CoreV1().PersistentVolumeClaims(ns).Get(pvcName, metav1.GetOptions{})
+		if err != nil {
+			glog.Errorf("failed to get PVC %s/%s: %v", ns, pvcName, err)
+			return
+		}
+		pvc.Annotations[util.AnnProvisionerEraseProgress] = fmt.Sprintf("%d%%", percent)
+		if _, err := c.kubeCli.CoreV1().PersistentVolumeClaims(ns).Update(pvc); err != nil {
+			glog.Errorf("failed to update erase progress of PVC %s/%s: %v", ns, pvcName, err)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package manager
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LVSize returns the size of the LV in bytes
+func (m *LVManager) LVSize(lvName, vgName string) (int64, error) {
+	return lvmBytes("lvs", "lv_size", vgName+"/"+lvName)
+}
+
+// VGFree returns the free space of the VG in bytes
+func (m *LVManager) VGFree(vgName string) (int64, error) {
+	return lvmBytes("vgs", "vg_free", vgName)
+}
+
+func lvmBytes(command, col, name string) (int64, error) {
+	output, err := runLVM(command, "--noheadings", "--units", "b", "--nosuffix", "-o", col, name)
+	if err != nil {
+		glog.Errorf("failed to get %s of %s: %v", col, name, err)
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
+}
+
+// ExtendLV extends the LV to size bytes, then the LUKS device and the
+// filesystem on it, the filesystem must be mounted
+func (m *LVManager) ExtendLV(lvName, vgName string, size int64) error {
+	unlock, err := m.lockVG(vgName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer m.Inventory.Invalidate()
+	if m.IsCached(lvName, vgName) {
+		return fmt.Errorf("can't extend cached LV %s/%s", vgName, lvName)
+	}
+	output, err := m.runLVMAudited("lvextend", "--size", fmt.Sprintf("%db", size), vgName+"/"+lvName)
+	if err != nil {
+		glog.Errorf("failed to extend LV %s/%s to %d bytes: %v", vgName, lvName, size, err)
+		return err
+	}
+	glog.Infof("lvextend output: %s", output)
+	if isCryptOpened(lvName, vgName) {
+		output, err := m.runAudited(nil, "cryptsetup", "resize", cryptName(lvName, vgName))
+		if err != nil {
+			glog.Errorf("failed to resize LUKS device of LV %s/%s: %v", vgName, lvName, err)
+			return err
+		}
+		glog.Infof("cryptsetup resize output: %s", output)
+	}
+	return m.growFS(lvName, vgName)
+}
+
+func (m *LVManager) growFS(lvName, vgName string) error {
+	devPath := getVolumePath(lvName, vgName)
+	fsType, err := probeSignature(devPath)
+	if err != nil {
+		return err
+	}
+	var args []string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		args = []string{"resize2fs", devPath}
+	case "xfs":
+		args = []string{"xfs_growfs", path.Join(m.BaseDir, lvName)}
+	default:
+		return fmt.Errorf("can't grow %q filesystem of LV %s/%s", fsType, vgName, lvName)
+	}
+	output, err := m.runAudited(nil, args[0], args[1:]...)
+	if err != nil {
+		glog.Errorf("failed to grow filesystem of LV %s/%s: %v", vgName, lvName, err)
+		return err
+	}
+	glog.Infof("%s output: %s", args[0], output)
+	return nil
+}
+
+// autoGrowVolumes grows the volumes provisioned on this node whose used space
+// reaches the threshold of their auto-grow options
+func (c *Controller) autoGrowVolumes() {
+	for _, obj := range c.store.List() {
+		pvc, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			continue
+		}
+		ann := pvc.GetAnnotations()
+		if ann[util.AnnProvisionerNode] != c.nodeName || ann[util.AnnProvisionerHostPath] == "" || pvc.Spec.VolumeName == "" {
+			continue
+		}
+		opts, err := util.AutoGrowOptionsFromAnnotations(ann)
+		if err != nil {
+			glog.Errorf("invalid auto-grow options of pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+			continue
+		}
+		if opts == nil {
+			continue
+		}
+		if err := c.autoGrow(pvc.DeepCopy(), opts); err != nil {
+			glog.Errorf("failed to grow pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		}
+	}
+}
+
+func (c *Controller) autoGrow(pvc *v1.PersistentVolumeClaim, opts *util.AutoGrowOptions) error {
+	ann := pvc.GetAnnotations()
+	lvName := ann[util.AnnProvisionerLVName]
+	vgName := ann[util.AnnProvisionerVGName]
+	hostPath := ann[util.AnnProvisionerHostPath]
+	// statfs of an unmounted hostPath reads the filesystem below it
+	if !isLVMounted(hostPath, lvName, vgName) {
+		return fmt.Errorf("LV %s/%s is not mounted at %s", vgName, lvName, hostPath)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(hostPath, &st); err != nil {
+		return err
+	}
+	capacity := int64(st.Blocks) * st.Bsize
+	used := int64(st.Blocks-st.Bfree) * st.Bsize
+	if !opts.ShouldGrow(used, capacity) {
+		return nil
+	}
+	size, err := c.lvm.LVSize(lvName, vgName)
+	if err != nil {
+		return err
+	}
+	next := opts.NextSize(size)
+	if next <= size {
+		glog.Warningf("pvc %s/%s is %d%% used but reaches the max size of auto-grow", pvc.Namespace, pvc.Name, used*100/capacity)
+		return nil
+	}
+	free, err := c.lvm.VGFree(vgName)
+	if err != nil {
+		return err
+	}
+	if free < next-size {
+		c.recorder.Eventf(pvc, v1.EventTypeWarning, "AutoGrowFailed",
+			"VG %s has %d bytes free, can't grow LV %s by %d bytes", vgName, free, lvName, next-size)
+		return nil
+	}
+	lvm := c.lvm.WithOperation(Operation{
+		Trigger:      "auto-grow",
+		PVCNamespace: pvc.Namespace,
+		PVCName:      pvc.Name,
+		PVName:       pvc.Spec.VolumeName,
+		VGName:       vgName,
+		LVName:       lvName,
+	})
+	if err := lvm.ExtendLV(lvName, vgName, next); err != nil {
+		c.recorder.Eventf(pvc, v1.EventTypeWarning, "AutoGrowFailed", "failed to grow LV %s: %v", lvName, err)
+		return err
+	}
+	if size, err = c.lvm.LVSize(lvName, vgName); err == nil {
+		next = size
+	}
+	c.recorder.Eventf(pvc, v1.EventTypeNormal, "AutoGrown",
+		"LV %s/%s grew to %d bytes, %d%% of the filesystem was used", vgName, lvName, next, used*100/capacity)
+	return c.updateVolumeSize(pvc, next)
+}
+
+// updateVolumeSize records the new size in the capacity of the PV and the
+// request and capacity of the PVC, the storage class of the PVC must set
+// allowVolumeExpansion for the request to be updated
+func (c *Controller) updateVolumeSize(pvc *v1.PersistentVolumeClaim, size int64) error {
+	quantity := *resource.NewQuantity(size, resource.BinarySI)
+	pv, err := c.kubeCli.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	pv.Spec.Capacity[v1.ResourceStorage] = quantity
+	if _, err := c.kubeCli.CoreV1().PersistentVolumes().Update(pv); err != nil {
+		glog.Errorf("failed to update capacity of pv %s: %v", pv.Name, err)
+		return err
+	}
+
+	pvc.Annotations[util.AnnProvisionerLVSize] = fmt.Sprintf("%db", size)
+	if pvc.Spec.Resources.Requests == nil {
+		pvc.Spec.Resources.Requests = v1.ResourceList{}
+	}
+	pvc.Spec.Resources.Requests[v1.ResourceStorage] = quantity
+	updated, err := c.kubeCli.CoreV1().PersistentVolumeClaims(pvc.Namespace).Update(pvc)
+	if err != nil {
+		// the request of a bound PVC can only be changed if volume
+		// expansion is allowed by its storage class
+		glog.Errorf("failed to update request of pvc %s/%s, allowVolumeExpansion of its storage class may be unset: %v", pvc.Namespace, pvc.Name, err)
+		c.recorder.Eventf(pvc, v1.EventTypeWarning, "AutoGrowFailed", "LV grew to %d bytes but the PVC request could not be updated, allowVolumeExpansion of the storage class may be unset: %v", size, err)
+		return err
+	}
+	pvc = updated
+	if pvc.Status.Capacity == nil {
+		pvc.Status.Capacity = v1.ResourceList{}
+	}
+	pvc.Status.Capacity[v1.ResourceStorage] = quantity
+	if _, err := c.kubeCli.CoreV1().PersistentVolumeClaims(pvc.Namespace).UpdateStatus(pvc); err != nil {
+		glog.Errorf("failed to update capacity of pvc %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	healthCheckInterval = time.Minute
+	// NodeConditionStorageDegraded is true when any VG, PV or LV of the node
+	// is unhealthy
+	NodeConditionStorageDegraded v1.NodeConditionType = "LVMStorageDegraded"
+)
+
+// lvHealthStates explains the volume health bit, the 9th character of
+// lv_attr
+var lvHealthStates = map[byte]string{
+	'p': "LV is partial, some of its PVs are missing",
+	'r': "RAID LV needs to be refreshed, one of its images failed",
+	'm': "RAID LV has mismatches",
+	'F': "thin LV or pool failed",
+	'D': "thin pool is out of data space",
+	'M': "thin pool metadata is read only",
+	'X': "LV health is unknown",
+}
+
+// HealthReport lists the problems of the VGs and LVs on the node, LVs are
+// keyed by vg/lv
+type HealthReport struct {
+	VGs map[string][]string
+	LVs map[string][]string
+}
+
+// Healthy reports whether no problem is found
+func (r HealthReport) Healthy() bool {
+	return len(r.VGs) == 0 && len(r.LVs) == 0
+}
+
+func (r HealthReport) String() string {
+	var problems []string
+	for vg, vgProblems := range r.VGs {
+		problems = append(problems, fmt.Sprintf("VG %s: %s", vg, strings.Join(vgProblems, ", ")))
+	}
+	for lv, lvProblems := range r.LVs {
+		problems = append(problems, fmt.Sprintf("LV %s: %s", lv, strings.Join(lvProblems, ", ")))
+	}
+	sort.Strings(problems)
+	return strings.Join(problems, "; ")
+}
+
+// CheckHealth finds missing PVs, partial VGs, unhealthy LVs and the
+// filesystems remounted read-only after errors
+func (m *LVManager) CheckHealth(vgs map[string]VolumeGroup) HealthReport {
+	report := HealthReport{VGs: map[string][]string{}, LVs: map[string][]string{}}
+	readOnly := readOnlyMounts()
+	for _, vg := range vgs {
+		var vgProblems []string
+		// the 4th character of vg_attr is p for a partial VG
+		if len(vg.Attr) > 3 && vg.Attr[3] == 'p' {
+			vgProblems = append(vgProblems, "VG is partial")
+		}
+		var missing []string
+		for _, pv := range vg.PVs {
+			// the 3rd character of pv_attr is m for a missing PV
+			if len(pv.Attr) > 2 && pv.Attr[2] == 'm' {
+				missing = append(missing, pv.Name)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			vgProblems = append(vgProblems, fmt.Sprintf("PVs %s are missing", strings.Join(missing, ",")))
+		} else if vg.MissingPVs > 0 {
+			vgProblems = append(vgProblems, fmt.Sprintf("%d PVs are missing", vg.MissingPVs))
+		}
+		if len(vgProblems) > 0 {
+			report.VGs[vg.Name] = vgProblems
+		}
+		for _, lv := range vg.LVs {
+			var lvProblems []string
+			if len(lv.Attr) > 4 && lv.Attr[4] == 's' {
+				lvProblems = append(lvProblems, "LV is suspended")
+			}
+			if len(lv.Attr) > 8 {
+				if problem, ok := lvHealthStates[lv.Attr[8]]; ok {
+					lvProblems = append(lvProblems, problem)
+				}
+			}
+			if readOnly[path.Join(m.BaseDir, lv.Name)] {
+				lvProblems = append(lvProblems, "filesystem is mounted read-only, it may be remounted after errors")
+			}
+			if len(lvProblems) > 0 {
+				report.LVs[vg.Name+"/"+lv.Name] = lvProblems
+			}
+		}
+	}
+	return report
+}
+
+// readOnlyMounts returns the mount points mounted read-only
+func readOnlyMounts() map[string]bool {
+	mounts := map[string]bool{}
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		glog.Errorf("failed to read /proc/mounts: %v", err)
+		return mounts
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		for _, opt := range strings.Split(fields[3], ",") {
+			if opt == "ro" {
+				mounts[fields[1]] = true
+			}
+		}
+	}
+	return mounts
+}
+
+// checkHealth publishes the storage health in the node condition and taint,
+// and records events on the PVCs whose LVs become abnormal or recover
+func (c *Controller) checkHealth() {
+	report := c.lvm.CheckHealth(c.lvm.VGs())
+	if !report.Healthy() {
+		glog.Warningf("storage is degraded: %s", report)
+	}
+	if err := c.updateHealthCondition(report); err != nil {
+		glog.Errorf("failed to update storage condition of node %s: %v", c.nodeName, err)
+	}
+	if err := c.updateHealthTaint(!report.Healthy()); err != nil {
+		glog.Errorf("failed to update storage taint of node %s: %v", c.nodeName, err)
+	}
+
+	volumeProblems := map[string]string{}
+	for _, obj := range c.store.List() {
+		pvc, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			continue
+		}
+		ann := pvc.GetAnnotations()
+		if ann[util.AnnProvisionerNode] != c.nodeName || ann[util.AnnProvisionerHostPath] == "" {
+			continue
+		}
+		vgName, lvName := ann[util.AnnProvisionerVGName], ann[util.AnnProvisionerLVName]
+		problems := append(append([]string{}, report.VGs[vgName]...), report.LVs[vgName+"/"+lvName]...)
+		message := strings.Join(problems, ", ")
+		key := pvc.Namespace + "/" + pvc.Name
+		if message != "" {
+			volumeProblems[key] = message
+		}
+		switch {
+		case message == c.volumeProblems[key]:
+		case message != "":
+			c.recordPVCEvent(pvc, v1.EventTypeWarning, "VolumeAbnormal", "LV %s/%s is abnormal: %s", vgName, lvName, message)
+		default:
+			c.recordPVCEvent(pvc, v1.EventTypeNormal, "VolumeRecovered", "LV %s/%s is healthy again", vgName, lvName)
+		}
+	}
+	c.volumeProblems = volumeProblems
+}
+
+func (c *Controller) updateHealthCondition(report HealthReport) error {
+	node, err := c.kubeCli.CoreV1().Nodes().Get(c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	now := metav1.Now()
+	condition := v1.NodeCondition{
+		Type:               NodeConditionStorageDegraded,
+		Status:             v1.ConditionFalse,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             "StorageHealthy",
+		Message:            "all VGs, PVs and LVs are healthy",
+	}
+	if !report.Healthy() {
+		condition.Status = v1.ConditionTrue
+		condition.Reason = "StorageDegraded"
+		condition.Message = report.String()
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == condition.Type && cond.Status == condition.Status {
+			condition.LastTransitionTime = cond.LastTransitionTime
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []v1.NodeCondition{condition},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeCli.CoreV1().Nodes().Patch(c.nodeName, types.StrategicMergePatchType, data, "status")
+	return err
+}
+
+// updateHealthTaint adds or removes the NoSchedule taint of degraded storage,
+// the taints are patched as a whole guarded by the resource version
+func (c *Controller) updateHealthTaint(degraded bool) error {
+	node, err := c.kubeCli.CoreV1().Nodes().Get(c.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	key := util.StorageDegradedTaintKey(c.domainName)
+	taints := []v1.Taint{}
+	tainted := false
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == key {
+			tainted = true
+			continue
+		}
+		taints = append(taints, taint)
+	}
+	if tainted == degraded {
+		return nil
+	}
+	if degraded {
+		now := metav1.Now()
+		taints = append(taints, v1.Taint{Key: key, Effect: v1.TaintEffectNoSchedule, TimeAdded: &now})
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": node.ResourceVersion},
+		"spec":     map[string]interface{}{"taints": taints},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.kubeCli.CoreV1().Nodes().Patch(c.nodeName, types.MergePatchType, data)
+	if err == nil {
+		glog.Infof("storage degraded taint of node %s: %v", c.nodeName, degraded)
+	}
+	return err
+}
@@ -0,0 +1,197 @@
+package manager
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// ImportTag marks a LV to be imported as a PV
+	ImportTag = "k8s.import"
+
+	defaultImportStorageClass = "lvm-volume-provisioner"
+)
+
+// ImportRule describes a pre-existing LV to be imported as a PV
+type ImportRule struct {
+	VGName string `json:"vgName"`
+	LVName string `json:"lvName"`
+	// FsType is the expected filesystem of the LV, any filesystem is
+	// accepted if it's empty
+	FsType string `json:"fsType,omitempty"`
+	// PVName defaults to lvm-<node>-<vg>-<lv>
+	PVName       string `json:"pvName,omitempty"`
+	StorageClass string `json:"storageClass,omitempty"`
+	// ClaimNamespace and ClaimName pre-bind the PV to a PVC
+	ClaimNamespace string `json:"claimNamespace,omitempty"`
+	ClaimName      string `json:"claimName,omitempty"`
+}
+
+// ImportLVs creates PVs for the LVs listed in rules and the LVs tagged with
+// ImportTag in managed VGs. The LVs are mounted but never formatted, and the
+// PVs are retained after released. A LV failed to import doesn't stop the
+// others, the errors are returned together.
+func (c *Controller) ImportLVs(vgs map[string]VolumeGroup, managed map[string]VolumeGroup, rules []ImportRule, storageClass string) error {
+	if storageClass == "" {
+		storageClass = defaultImportStorageClass
+	}
+	var imports []ImportRule
+	for _, rule := range rules {
+		if rule.StorageClass == "" {
+			rule.StorageClass = storageClass
+		}
+		imports = append(imports, rule)
+	}
+	for _, vg := range managed {
+		for _, lv := range vg.LVs {
+			if !util.HasTag(lv.Tags, ImportTag) || util.LVOwnerUID(lv.Tags) != "" {
+				continue
+			}
+			rule := ImportRule{VGName: vg.Name, LVName: lv.Name, StorageClass: storageClass}
+			// the claim may be recorded in owner tags without UID
+			rule.ClaimNamespace, rule.ClaimName, _ = util.LVOwner(lv.Tags)
+			imports = append(imports, rule)
+		}
+	}
+	var errs []error
+	for _, rule := range imports {
+		lv, ok := vgs[rule.VGName].LVs[rule.LVName]
+		if !ok {
+			errs = append(errs, fmt.Errorf("LV %s/%s to import not found", rule.VGName, rule.LVName))
+			continue
+		}
+		if vgName := sharedLVName(vgs, rule.LVName, rule.VGName); vgName != "" {
+			// LVs are mounted at BaseDir/<lvName> whatever their VG is
+			errs = append(errs, fmt.Errorf("LV %s/%s isn't imported, VG %s has a LV of the same name", rule.VGName, rule.LVName, vgName))
+			continue
+		}
+		if err := c.importLV(rule, lv); err != nil {
+			errs = append(errs, fmt.Errorf("failed to import LV %s/%s: %v", rule.VGName, rule.LVName, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// sharedLVName returns another VG which has a LV of the name
+func sharedLVName(vgs map[string]VolumeGroup, lvName, vgName string) string {
+	for name, vg := range vgs {
+		if _, ok := vg.LVs[lvName]; ok && name != vgName {
+			return name
+		}
+	}
+	return ""
+}
+
+func (c *Controller) importLV(rule ImportRule, lv LogicalVolume) error {
+	pvName := rule.PVName
+	if pvName == "" {
+		pvName = importPVName(c.nodeName, rule.VGName, rule.LVName)
+	}
+	lvm := c.lvm.WithOperation(Operation{
+		Trigger:      "import",
+		PVCNamespace: rule.ClaimNamespace,
+		PVCName:      rule.ClaimName,
+		PVName:       pvName,
+		VGName:       rule.VGName,
+		LVName:       rule.LVName,
+	})
+	pv, err := c.kubeCli.CoreV1().PersistentVolumes().Get(pvName, metav1.GetOptions{})
+	if err == nil {
+		if pv.GetAnnotations()[util.AnnProvisionerImported] != "true" {
+			return fmt.Errorf("PV %s already exists and is not imported", pvName)
+		}
+		// mount again after node restarts
+		_, err := lvm.MountLV(rule.LVName, rule.VGName)
+		return err
+	}
+	if !apierr.IsNotFound(err) {
+		return err
+	}
+
+	fsType, err := probeSignature(getVolumePath(rule.LVName, rule.VGName))
+	if err != nil {
+		return err
+	}
+	if fsType == "" || (rule.FsType != "" && fsType != rule.FsType) {
+		return fmt.Errorf("LV has filesystem %q, expect %q, LVs are imported without formatting", fsType, rule.FsType)
+	}
+	size, err := parseLVMSize(lv.Size)
+	if err != nil {
+		return err
+	}
+	hostPath, err := lvm.MountLV(rule.LVName, rule.VGName)
+	if err != nil {
+		return err
+	}
+
+	pv = &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   pvName,
+			Labels: map[string]string{},
+			Annotations: map[string]string{
+				util.AnnProvisionerNode:     c.nodeName,
+				util.AnnProvisionerHostPath: hostPath,
+				util.AnnProvisionerVGName:   rule.VGName,
+				util.AnnProvisionerLVName:   rule.LVName,
+				util.AnnProvisionerLVSize:   fmt.Sprintf("%db", size),
+				util.AnnProvisionerLVFsType: fsType,
+				util.AnnProvisionerImported: "true",
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			// imported data is never deleted by us
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			AccessModes:                   []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			StorageClassName:              rule.StorageClass,
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: *resource.NewQuantity(size, resource.BinarySI),
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				HostPath: &v1.HostPathVolumeSource{Path: hostPath},
+			},
+		},
+	}
+	// LVM names may contain + and be longer than label values, such labels
+	// are left out, the annotations always record the names
+	for key, value := range map[string]string{
+		util.AnnProvisionerNode:   c.nodeName,
+		util.AnnProvisionerVGName: rule.VGName,
+		util.AnnProvisionerLVName: rule.LVName,
+	} {
+		if len(validation.IsValidLabelValue(value)) == 0 {
+			pv.Labels[key] = value
+		}
+	}
+	if rule.ClaimName != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: rule.ClaimNamespace, Name: rule.ClaimName}
+	}
+	if _, err := c.kubeCli.CoreV1().PersistentVolumes().Create(pv); err != nil {
+		return err
+	}
+	glog.Infof("imported LV %s/%s as PV %s", rule.VGName, rule.LVName, pvName)
+	return nil
+}
+
+// importPVName returns a valid DNS subdomain name of the PV for the LV
+func importPVName(nodeName, vgName, lvName string) string {
+	name := strings.ToLower(fmt.Sprintf("lvm-%s-%s-%s", nodeName, vgName, lvName))
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, name)
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return strings.Trim(name, "-.")
+}
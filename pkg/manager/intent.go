@@ -0,0 +1,214 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const intentDir = "intents"
+
+// IntentPhase is the last finished step of provisioning a LV
+type IntentPhase string
+
+const (
+	PhasePending   IntentPhase = "Pending"
+	PhaseAllocated IntentPhase = "Allocated"
+	PhaseErased    IntentPhase = "Erased"
+	PhaseEncrypted IntentPhase = "Encrypted"
+	PhaseFormatted IntentPhase = "Formatted"
+	PhaseMounted   IntentPhase = "Mounted"
+	PhaseDone      IntentPhase = "Done"
+)
+
+var intentPhases = []IntentPhase{
+	PhasePending,
+	PhaseAllocated,
+	PhaseErased,
+	PhaseEncrypted,
+	PhaseFormatted,
+	PhaseMounted,
+	PhaseDone,
+}
+
+// Intent is the node local record of provisioning a LV for a PVC, it
+// survives manager restarts so that provisioning can be resumed or rolled
+// back and a formatted LV is never formatted again
+type Intent struct {
+	PVCNamespace string      `json:"pvcNamespace"`
+	PVCName      string      `json:"pvcName"`
+	PVCUID       string      `json:"pvcUID"`
+	LVName       string      `json:"lvName"`
+	VGName       string      `json:"vgName"`
+	Created      bool        `json:"created"`
+	Phase        IntentPhase `json:"phase"`
+	StartTime    time.Time   `json:"startTime"`
+}
+
+// operation returns the audit operation of changes made for the intent
+func (i *Intent) operation(trigger string) Operation {
+	return Operation{
+		Trigger:      trigger,
+		PVCNamespace: i.PVCNamespace,
+		PVCName:      i.PVCName,
+		VGName:       i.VGName,
+		LVName:       i.LVName,
+	}
+}
+
+// Reached reports whether the intent has finished the phase
+func (i *Intent) Reached(phase IntentPhase) bool {
+	return phaseIndex(i.Phase) >= phaseIndex(phase)
+}
+
+func phaseIndex(phase IntentPhase) int {
+	for i, p := range intentPhases {
+		if p == phase {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *LVManager) intentFile(lvName, vgName string) string {
+	return path.Join(m.StateDir, intentDir, fmt.Sprintf("%s_%s.json", vgName, lvName))
+}
+
+// LoadIntent returns the intent of the LV, or nil if there is none
+func (m *LVManager) LoadIntent(lvName, vgName string) (*Intent, error) {
+	data, err := ioutil.ReadFile(m.intentFile(lvName, vgName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	intent := &Intent{}
+	if err := json.Unmarshal(data, intent); err != nil {
+		return nil, fmt.Errorf("invalid intent of LV %s/%s: %v", vgName, lvName, err)
+	}
+	return intent, nil
+}
+
+// SaveIntent persists the intent atomically
+func (m *LVManager) SaveIntent(intent *Intent) error {
+	data, err := json.Marshal(intent)
+	if err != nil {
+		return err
+	}
+	file := m.intentFile(intent.LVName, intent.VGName)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		glog.Errorf("failed to write intent %s: %v", tmp, err)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// AdvanceIntent moves the intent to the phase and persists it
+func (m *LVManager) AdvanceIntent(intent *Intent, phase IntentPhase) error {
+	intent.Phase = phase
+	if err := m.SaveIntent(intent); err != nil {
+		glog.Errorf("failed to save intent of LV %s/%s in phase %s: %v", intent.VGName, intent.LVName, phase, err)
+		return err
+	}
+	return nil
+}
+
+func (m *LVManager) DeleteIntent(lvName, vgName string) error {
+	err := os.Remove(m.intentFile(lvName, vgName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *LVManager) ListIntents() ([]*Intent, error) {
+	files, err := ioutil.ReadDir(path.Join(m.StateDir, intentDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var intents []*Intent
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(m.StateDir, intentDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		intent := &Intent{}
+		if err := json.Unmarshal(data, intent); err != nil {
+			glog.Errorf("invalid intent %s: %v", f.Name(), err)
+			continue
+		}
+		intents = append(intents, intent)
+	}
+	return intents, nil
+}
+
+// RollbackIntent undoes an unfinished provisioning: the LV is unmounted,
+// closed and removed if it was created by the intent, then the intent is
+// deleted so that provisioning starts over
+func (m *LVManager) RollbackIntent(intent *Intent) error {
+	glog.Infof("rolling back LV %s/%s of PVC %s/%s in phase %s",
+		intent.VGName, intent.LVName, intent.PVCNamespace, intent.PVCName, intent.Phase)
+	lvm := m.WithOperation(intent.operation("rollback"))
+	if err := lvm.UnmountLV(intent.LVName); err != nil {
+		return err
+	}
+	if err := lvm.CloseEncryptedLV(intent.LVName, intent.VGName); err != nil {
+		return err
+	}
+	// a LV of the name created by others meanwhile isn't tagged for the PVC
+	if lv, ok := m.VGs()[intent.VGName].LVs[intent.LVName]; ok && intent.Created && util.LVOwnerUID(lv.Tags) == intent.PVCUID {
+		if err := lvm.RemoveLV(intent.LVName, intent.VGName); err != nil {
+			return err
+		}
+	}
+	return m.DeleteIntent(intent.LVName, intent.VGName)
+}
+
+// RecoverIntents rolls back the unfinished intents whose PVCs are deleted,
+// recreated or not scheduled to this node any more, the others are resumed
+// by syncing their PVCs
+func (c *Controller) RecoverIntents() error {
+	intents, err := c.lvm.ListIntents()
+	if err != nil {
+		glog.Errorf("failed to list intents: %v", err)
+		return err
+	}
+	for _, intent := range intents {
+		if intent.Reached(PhaseDone) {
+			continue
+		}
+		pvc, err := c.kubeCli.CoreV1().PersistentVolumeClaims(intent.PVCNamespace).Get(intent.PVCName, metav1.GetOptions{})
+		if err != nil && !apierr.IsNotFound(err) {
+			return err
+		}
+		if err == nil && pvc.GetAnnotations()[util.AnnProvisionerNode] == c.nodeName && string(pvc.UID) == intent.PVCUID {
+			glog.Infof("resuming LV %s/%s of PVC %s/%s from phase %s",
+				intent.VGName, intent.LVName, intent.PVCNamespace, intent.PVCName, intent.Phase)
+			continue
+		}
+		if err := c.lvm.RollbackIntent(intent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
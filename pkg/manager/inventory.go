@@ -0,0 +1,159 @@
+package manager
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const deviceMapperDir = "/dev/mapper"
+
+// Inventory caches the LVM status of the node, it's refreshed periodically
+// and lazily after being invalidated by changes made by the manager itself
+type Inventory struct {
+	lock sync.RWMutex
+	vgs  map[string]VolumeGroup
+	// generation is bumped by every invalidation, scanned is the generation
+	// vgs are scanned at, the inventory is stale while they differ
+	generation uint64
+	scanned    uint64
+
+	// serializes scans so that concurrent readers of a stale inventory
+	// don't run vgs, pvs and lvs more than once
+	refreshLock sync.Mutex
+	// changed is signaled by invalidations and scans
+	changed chan struct{}
+}
+
+// NewInventory returns an empty inventory which is scanned on first read
+func NewInventory() *Inventory {
+	return &Inventory{vgs: map[string]VolumeGroup{}, generation: 1, changed: make(chan struct{}, 1)}
+}
+
+// Changed is signaled once the inventory is invalidated or rescanned, the
+// signals not received yet are coalesced
+func (i *Inventory) Changed() <-chan struct{} {
+	return i.changed
+}
+
+func (i *Inventory) notify() {
+	select {
+	case i.changed <- struct{}{}:
+	default:
+	}
+}
+
+// VGs returns the cached VGs, they are rescanned first if the inventory is
+// invalidated, readers wait for a scan started after the invalidation. The
+// result is shared by all readers and must not be modified.
+func (i *Inventory) VGs() map[string]VolumeGroup {
+	i.lock.RLock()
+	vgs, generation, scanned := i.vgs, i.generation, i.scanned
+	i.lock.RUnlock()
+	if scanned >= generation {
+		return vgs
+	}
+	if err := i.refreshTo(generation); err != nil {
+		glog.Errorf("failed to refresh LVM inventory, use the cached one: %v", err)
+	}
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return i.vgs
+}
+
+// Invalidate marks the inventory as stale, it's rescanned on next read
+func (i *Inventory) Invalidate() {
+	i.lock.Lock()
+	i.generation++
+	i.lock.Unlock()
+	i.notify()
+}
+
+// Refresh rescans LVM
+func (i *Inventory) Refresh() error {
+	i.refreshLock.Lock()
+	defer i.refreshLock.Unlock()
+	return i.refresh()
+}
+
+// refreshTo rescans LVM unless a scan started after the generation has
+// finished meanwhile
+func (i *Inventory) refreshTo(generation uint64) error {
+	i.refreshLock.Lock()
+	defer i.refreshLock.Unlock()
+	i.lock.RLock()
+	scanned := i.scanned
+	i.lock.RUnlock()
+	if scanned >= generation {
+		return nil
+	}
+	return i.refresh()
+}
+
+func (i *Inventory) refresh() error {
+	// invalidations during the scan keep the inventory stale
+	i.lock.RLock()
+	generation := i.generation
+	i.lock.RUnlock()
+	vgs, err := loadVGs()
+	if err != nil {
+		return err
+	}
+	i.lock.Lock()
+	i.vgs = vgs
+	if generation > i.scanned {
+		i.scanned = generation
+	}
+	i.lock.Unlock()
+	reportVGMetrics(vgs)
+	i.notify()
+	return nil
+}
+
+// Run refreshes the inventory every interval and, if watchDevices is true,
+// invalidates it once device-mapper devices are created or removed, which
+// catches changes made by other tools
+func (i *Inventory) Run(interval time.Duration, watchDevices bool, stopCh <-chan struct{}) {
+	if watchDevices {
+		go i.watchDeviceMapper(stopCh)
+	}
+	wait.Until(func() {
+		if err := i.Refresh(); err != nil {
+			glog.Errorf("failed to refresh LVM inventory: %v", err)
+		}
+	}, interval, stopCh)
+}
+
+// watchDeviceMapper invalidates the inventory on inotify events of the
+// device-mapper directory maintained by udev, the blocking read returns with
+// the process so the watch outlives stopCh by at most one event
+func (i *Inventory) watchDeviceMapper(stopCh <-chan struct{}) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		glog.Errorf("failed to init inotify, device changes are not watched: %v", err)
+		return
+	}
+	defer syscall.Close(fd)
+	if _, err := syscall.InotifyAddWatch(fd, deviceMapperDir, syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MOVE); err != nil {
+		glog.Errorf("failed to watch %s, device changes are not watched: %v", deviceMapperDir, err)
+		return
+	}
+	buf := make([]byte, 4096)
+	for {
+		// events are only used as a signal, their content doesn't matter
+		if _, err := syscall.Read(fd, buf); err != nil {
+			glog.Errorf("failed to read inotify events of %s: %v", deviceMapperDir, err)
+			return
+		}
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		glog.V(4).Infof("%s changed, invalidate LVM inventory", deviceMapperDir)
+		i.Invalidate()
+	}
+}
@@ -0,0 +1,165 @@
+package manager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"golang.org/x/sys/unix"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podCgroupMaxDepth is how deep pod cgroups are searched under the cgroup
+// root, e.g. kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice
+const podCgroupMaxDepth = 3
+
+// SetIOLimits writes the io.max of the pod cgroup for the device of the LV,
+// nil limits remove the limits set before
+func (m *LVManager) SetIOLimits(lvName, vgName, cgroupDir string, limits *util.IOLimits) (bool, error) {
+	var st syscall.Stat_t
+	devPath := getVolumePath(lvName, vgName)
+	if err := syscall.Stat(devPath, &st); err != nil {
+		return false, fmt.Errorf("failed to stat %s: %v", devPath, err)
+	}
+	major, minor := unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))
+	file := path.Join(cgroupDir, "io.max")
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return false, fmt.Errorf("%s doesn't exist, the io controller of cgroup v2 isn't enabled", file)
+	}
+	if err != nil {
+		return false, err
+	}
+	prefix := fmt.Sprintf("%d:%d ", major, minor)
+	current := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			current = line
+		}
+	}
+	var line string
+	if limits != nil {
+		line = limits.IOMax(major, minor)
+	} else if current != "" {
+		line = (&util.IOLimits{}).IOMax(major, minor)
+	}
+	if line == current || line == "" {
+		return false, nil
+	}
+	start := time.Now()
+	err = ioutil.WriteFile(file, []byte(line), 0644)
+	m.audit("io.max", []string{file, line}, start, err)
+	if err != nil {
+		glog.Errorf("failed to write %q to %s: %v", line, file, err)
+		return false, err
+	}
+	glog.Infof("set io.max of %s: %s", cgroupDir, line)
+	return true, nil
+}
+
+// podCgroupDir finds the cgroup of the pod created by either the systemd or
+// the cgroupfs cgroup driver of kubelet
+func podCgroupDir(root, podUID string) (string, error) {
+	cgroupfsName := "pod" + podUID
+	systemdSuffix := "-pod" + strings.Replace(podUID, "-", "_", -1) + ".slice"
+	dirs := []string{root}
+	for depth := 0; depth < podCgroupMaxDepth && len(dirs) > 0; depth++ {
+		var next []string
+		for _, dir := range dirs {
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return "", err
+			}
+			for _, entry := range entries {
+				name := entry.Name()
+				if !entry.IsDir() || depth == 0 && !strings.HasPrefix(name, "kubepods") {
+					continue
+				}
+				if name == cgroupfsName || strings.HasSuffix(name, systemdSuffix) {
+					return path.Join(dir, name), nil
+				}
+				next = append(next, path.Join(dir, name))
+			}
+		}
+		dirs = next
+	}
+	return "", fmt.Errorf("cgroup of pod %s not found under %s", podUID, root)
+}
+
+// applyPodIOLimits applies the IO limits of the PVCs provisioned on this
+// node to the cgroup of the running pod using them, a restarted pod gets
+// a new cgroup and the limits are applied again once it's running
+func (c *Controller) applyPodIOLimits(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Status.Phase != v1.PodRunning || c.lvm.CgroupRoot == "" {
+		return
+	}
+	var cgroupDir string
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		key := pod.Namespace + "/" + volume.PersistentVolumeClaim.ClaimName
+		obj, exists, err := c.store.GetByKey(key)
+		if err != nil || !exists {
+			continue
+		}
+		pvc := obj.(*v1.PersistentVolumeClaim)
+		ann := pvc.GetAnnotations()
+		if ann[util.AnnProvisionerNode] != c.nodeName || ann[util.AnnProvisionerHostPath] == "" {
+			continue
+		}
+		limits, err := util.IOLimitsFromAnnotations(ann)
+		if err != nil {
+			glog.Errorf("invalid IO limits of PVC %s: %v", key, err)
+			continue
+		}
+		if cgroupDir == "" {
+			cgroupDir, err = podCgroupDir(c.lvm.CgroupRoot, string(pod.UID))
+			if err != nil {
+				glog.Errorf("failed to find cgroup of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+				return
+			}
+		}
+		lvName, vgName := ann[util.AnnProvisionerLVName], ann[util.AnnProvisionerVGName]
+		lvm := c.lvm.WithOperation(Operation{
+			Trigger:      "pod-running",
+			PVCNamespace: pvc.Namespace,
+			PVCName:      pvc.Name,
+			PVName:       pvc.Spec.VolumeName,
+			VGName:       vgName,
+			LVName:       lvName,
+		})
+		changed, err := lvm.SetIOLimits(lvName, vgName, cgroupDir, limits)
+		if err != nil {
+			glog.Errorf("failed to set IO limits of PVC %s for pod %s/%s: %v", key, pod.Namespace, pod.Name, err)
+			c.recorder.Eventf(pod, v1.EventTypeWarning, "IOLimitFailed", "failed to set IO limits of PVC %s: %v", pvc.Name, err)
+			continue
+		}
+		if changed && limits != nil {
+			c.recorder.Eventf(pod, v1.EventTypeNormal, "IOLimited", "limited IO of PVC %s: %s", pvc.Name, limits)
+		}
+	}
+}
+
+// newPodInformer watches the pods of this node to apply IO limits, the
+// limits changed on PVCs are applied on resync
+func (c *Controller) newPodInformer() cache.Controller {
+	lw := cache.NewListWatchFromClient(c.kubeCli.CoreV1().RESTClient(), "pods", "",
+		fields.OneTermEqualSelector("spec.nodeName", c.nodeName))
+	_, controller := cache.NewInformer(lw, &v1.Pod{}, 30*time.Second, cache.ResourceEventHandlerFuncs{
+		AddFunc: c.applyPodIOLimits,
+		UpdateFunc: func(old, cur interface{}) {
+			c.applyPodIOLimits(cur)
+		},
+	})
+	return controller
+}
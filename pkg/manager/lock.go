@@ -0,0 +1,88 @@
+package manager
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	hostLockTimeout      = 5 * time.Minute
+	hostLockPollInterval = 100 * time.Millisecond
+)
+
+// vgLocks serializes the mutating operations on each VG among the workers
+var vgLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: map[string]*sync.Mutex{}}
+
+func vgLock(vgName string) *sync.Mutex {
+	vgLocks.Lock()
+	defer vgLocks.Unlock()
+	lock, ok := vgLocks.locks[vgName]
+	if !ok {
+		lock = &sync.Mutex{}
+		vgLocks.locks[vgName] = lock
+	}
+	return lock
+}
+
+// lockVG takes the lock of the VG in this process, then the advisory lock
+// file shared with other LVM users of the host, it returns the function
+// releasing both
+func (m *LVManager) lockVG(vgName string) (func(), error) {
+	start := time.Now()
+	lock := vgLock(vgName)
+	lock.Lock()
+	lockWaitDuration.Observe(time.Since(start).Seconds(), "vg")
+	if m.LockFile == "" {
+		return lock.Unlock, nil
+	}
+	unlockHost, err := lockHost(m.LockFile)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockHost()
+		lock.Unlock()
+	}, nil
+}
+
+// lockHost takes the exclusive flock of the file, which can be taken by
+// scripts with `flock <file> lvcreate ...` as well
+func lockHost(file string) (func(), error) {
+	start := time.Now()
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = wait.PollImmediate(hostLockPollInterval, hostLockTimeout, func() (bool, error) {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	lockWaitDuration.Observe(time.Since(start).Seconds(), "host")
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", file, err)
+	}
+	return func() {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+			glog.Errorf("failed to unlock %s: %v", file, err)
+		}
+		f.Close()
+	}, nil
+}
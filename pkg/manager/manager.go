@@ -3,17 +3,33 @@ package manager
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 type LVManager struct {
-	BaseDir string
-	LVM     map[string]VolumeGroup
+	BaseDir   string
+	StateDir  string
+	Inventory *Inventory
+	// LockFile is the advisory lock file taken by mutating operations to
+	// coordinate with other LVM users of the host, no lock if it's empty
+	LockFile string
+	// Audit records the commands changing the node storage if it's not nil
+	Audit *AuditLog
+	// CgroupRoot is where the cgroup v2 hierarchy of the host is mounted
+	CgroupRoot string
+
+	op Operation
 }
 
 type LVMReport struct {
@@ -27,11 +43,14 @@ type Report struct {
 }
 
 type LV struct {
-	LVUUID string `json:"lv_uuid"`
-	LVName string `json:"lv_name"`
-	LVSize string `json:"lv_size"`
-	LVPath string `json:"lv_path"`
-	VGName string `json:"vg_name"`
+	LVUUID  string `json:"lv_uuid"`
+	LVName  string `json:"lv_name"`
+	LVSize  string `json:"lv_size"`
+	LVPath  string `json:"lv_path"`
+	VGName  string `json:"vg_name"`
+	SegType string `json:"segtype"`
+	LVTags  string `json:"lv_tags"`
+	LVAttr  string `json:"lv_attr"`
 }
 
 type PV struct {
@@ -40,6 +59,8 @@ type PV struct {
 	VGName string `json:"vg_name"`
 	PVSize string `json:"pv_size"`
 	PVFree string `json:"pv_free"`
+	PVTags string `json:"pv_tags"`
+	PVAttr string `json:"pv_attr"`
 }
 
 type VG struct {
@@ -50,6 +71,9 @@ type VG struct {
 	LVCount string `json:"lv_count"`
 	PVCount string `json:"pv_count"`
 	VGTags  string `json:"vg_tags"`
+	VGAttr  string `json:"vg_attr"`
+	// MissingPVCount counts the PVs of the VG which can't be found
+	MissingPVCount string `json:"vg_missing_pv_count"`
 }
 
 type PhysicalVolume struct {
@@ -57,13 +81,18 @@ type PhysicalVolume struct {
 	Name string
 	Size string
 	Free string
+	Tags []string
+	Attr string
 }
 
 type LogicalVolume struct {
-	UUID string
-	Name string
-	Size string
-	Path string
+	UUID    string
+	Name    string
+	Size    string
+	Path    string
+	SegType string
+	Tags    []string
+	Attr    string
 }
 
 type VolumeGroup struct {
@@ -72,14 +101,17 @@ type VolumeGroup struct {
 	Size string
 	Free string
 	Tags []string
-	PVs  map[string]PhysicalVolume
-	LVs  map[string]LogicalVolume
+	Attr string
+	// MissingPVs counts the PVs of the VG which can't be found
+	MissingPVs int
+	PVs        map[string]PhysicalVolume
+	LVs        map[string]LogicalVolume
 }
 
 func scanLVM() (LVMReport, error) {
 	var report LVMReport
-	vg_cols := "vg_uuid,vg_name,vg_size,vg_free,lv_count,pv_count,vg_tags"
-	vgs, err := exec.Command("vgs", "-o", vg_cols, "--units", "H", "--reportformat", "json").Output()
+	vg_cols := "vg_uuid,vg_name,vg_size,vg_free,lv_count,pv_count,vg_tags,vg_attr,vg_missing_pv_count"
+	vgs, err := runLVM("vgs", "-o", vg_cols, "--units", "H", "--reportformat", "json")
 	if err != nil {
 		glog.Errorf("failed to list vg: %v", err)
 		return report, err
@@ -91,8 +123,8 @@ func scanLVM() (LVMReport, error) {
 	}
 	glog.Infof("lvm: %+v", report)
 
-	pv_cols := "pv_uuid,pv_name,vg_name,pv_size,pv_free"
-	pvs, err := exec.Command("pvs", "-o", pv_cols, "--units", "H", "--reportformat", "json").Output()
+	pv_cols := "pv_uuid,pv_name,vg_name,pv_size,pv_free,pv_tags,pv_attr"
+	pvs, err := runLVM("pvs", "-o", pv_cols, "--units", "H", "--reportformat", "json")
 	if err != nil {
 		glog.Errorf("failed to list pv: %v", err)
 		return report, err
@@ -104,8 +136,8 @@ func scanLVM() (LVMReport, error) {
 	}
 	glog.Infof("lvm: %+v", report)
 
-	lv_cols := "lv_uuid,lv_name,lv_size,lv_path,vg_name"
-	lvs, err := exec.Command("lvs", "-o", lv_cols, "--units", "H", "--reportformat", "json").Output()
+	lv_cols := "lv_uuid,lv_name,lv_size,lv_path,vg_name,segtype,lv_tags,lv_attr"
+	lvs, err := runLVM("lvs", "-o", lv_cols, "--units", "H", "--reportformat", "json")
 	if err != nil {
 		glog.Errorf("failed to list lv: %v", err)
 		return report, err
@@ -119,22 +151,35 @@ func scanLVM() (LVMReport, error) {
 	return report, nil
 }
 
+// SyncLVMStatus rescans LVM and refreshes the inventory
 func (m *LVManager) SyncLVMStatus() error {
+	return m.Inventory.Refresh()
+}
+
+// VGs returns the VGs in the inventory, the result must not be modified
+func (m *LVManager) VGs() map[string]VolumeGroup {
+	return m.Inventory.VGs()
+}
+
+func loadVGs() (map[string]VolumeGroup, error) {
 	vgs := map[string]VolumeGroup{}
 	report, err := scanLVM()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, lvm := range report.Report {
 		for _, vg := range lvm.VG {
+			missing, _ := strconv.Atoi(vg.MissingPVCount)
 			vgs[vg.VGName] = VolumeGroup{
-				UUID: vg.VGUUID,
-				Name: vg.VGName,
-				Size: vg.VGSize,
-				Free: vg.VGFree,
-				PVs:  make(map[string]PhysicalVolume),
-				LVs:  make(map[string]LogicalVolume),
-				Tags: strings.Split(vg.VGTags, ","),
+				UUID:       vg.VGUUID,
+				Name:       vg.VGName,
+				Size:       vg.VGSize,
+				Free:       vg.VGFree,
+				PVs:        make(map[string]PhysicalVolume),
+				LVs:        make(map[string]LogicalVolume),
+				Tags:       splitTags(vg.VGTags),
+				Attr:       vg.VGAttr,
+				MissingPVs: missing,
 			}
 		}
 		for _, pv := range lvm.PV {
@@ -143,46 +188,365 @@ func (m *LVManager) SyncLVMStatus() error {
 				Name: pv.PVName,
 				Size: pv.PVSize,
 				Free: pv.PVFree,
+				Tags: splitTags(pv.PVTags),
+				Attr: pv.PVAttr,
 			}
-			pvs := vgs[pv.VGName].PVs
-			pvs[pv.PVName] = p
+			vg, ok := vgs[pv.VGName]
+			if !ok { // PV not in any VG yet
+				continue
+			}
+			vg.PVs[pv.PVName] = p
 		}
 		for _, lv := range lvm.LV {
 			l := LogicalVolume{
-				UUID: lv.LVUUID,
-				Name: lv.LVName,
-				Size: lv.LVSize,
-				Path: lv.LVPath,
+				UUID:    lv.LVUUID,
+				Name:    lv.LVName,
+				Size:    lv.LVSize,
+				Path:    lv.LVPath,
+				SegType: lv.SegType,
+				Tags:    splitTags(lv.LVTags),
+				Attr:    lv.LVAttr,
 			}
 			lvs := vgs[lv.VGName].LVs
 			lvs[lv.LVName] = l
 		}
 	}
-	m.LVM = vgs
-	return nil
+	return vgs, nil
 }
 
-func (m *LVManager) AllocateLV(lvName, vgName string, size string) error {
-	vg, ok := m.LVM[vgName]
+// AllocateLV creates the LV tagged with tags, an existing LV is reused only
+// if it's owned by the same PVC as the tags
+func (m *LVManager) AllocateLV(lvName, vgName string, size string, layout util.LVLayout, cache *util.CacheOptions, tags []string) error {
+	unlock, err := m.lockVG(vgName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	vg, ok := m.VGs()[vgName]
 	if !ok {
 		return fmt.Errorf("no vg named %s", vgName)
 	}
+	defer m.Inventory.Invalidate()
 	if _, ok := vg.LVs[lvName]; ok {
+		if err := m.VerifyLVReusable(lvName, vgName, util.LVOwnerUID(tags)); err != nil {
+			return err
+		}
 		glog.Infof("lv %s already exist", lvName)
+		if cache != nil {
+			// attaching the cache may have failed after the LV is created
+			return m.attachCache(lvName, vgName, size, cache)
+		}
 		return nil
 	}
-	output, err := exec.Command("lvcreate", "--zero", "n", "--name", lvName, "--size", size, vgName).Output()
+	if err := vg.checkLayout(lvName, size, layout, cache); err != nil {
+		return err
+	}
+	args := []string{"--zero", "n", "--name", lvName, "--size", size}
+	for _, tag := range tags {
+		args = append(args, "--addtag", tag)
+	}
+	switch layout.Type {
+	case util.LVTypeStriped:
+		args = append(args, "--type", layout.Type, "--stripes", strconv.Itoa(layout.Stripes))
+	case util.LVTypeRaid1:
+		args = append(args, "--type", layout.Type, "--mirrors", "1")
+	case util.LVTypeRaid10:
+		args = append(args, "--type", layout.Type, "--mirrors", "1", "--stripes", strconv.Itoa(layout.Stripes))
+	}
+	if layout.StripeSize != "" {
+		args = append(args, "--stripesize", layout.StripeSize)
+	}
+	args = append(args, vgName)
+	if cache != nil {
+		// keep the origin LV off the fast PVs reserved for cache pools
+		slowPVs := vg.pvsWithoutTag(cache.PVTag)
+		if len(slowPVs) == 0 {
+			return fmt.Errorf("vg %s has no PV without tag %s for origin LV", vgName, cache.PVTag)
+		}
+		args = append(args, slowPVs...)
+	}
+	output, err := m.runLVMAudited("lvcreate", args...)
+	if commandErrorReason(err) == ReasonAlreadyExists {
+		// the LV is created after LVM status is synced
+		if err := verifyLVTags(lvName, vgName, util.LVOwnerUID(tags)); err != nil || cache == nil {
+			return err
+		}
+		return m.attachCache(lvName, vgName, size, cache)
+	}
 	if err != nil {
-		glog.Errorf("failed to create LV %s with size %s: %v", lvName, size, err)
+		glog.Errorf("failed to create %s LV %s with size %s: %v", layout.Type, lvName, size, err)
 		return err
 	}
 	glog.Infof("lvcreate output: %s", output)
+	if cache != nil {
+		return m.attachCache(lvName, vgName, size, cache)
+	}
 	return nil
 }
 
-func (m *LVManager) FormatLV(lvName, vgName string, fsType string) error {
-	devPath := getDevPath(lvName, vgName)
-	output, err := exec.Command("mkfs", "--type", fsType, devPath).Output()
+// checkLayout returns a non-retryable error unless the VG has enough PVs
+// with enough free space for the striped or raid LV, the PVs reserved for
+// cache pools don't hold the LV
+func (vg VolumeGroup) checkLayout(lvName, size string, layout util.LVLayout, cache *util.CacheOptions) error {
+	if layout.Type == util.LVTypeLinear || layout.Type == "" {
+		return nil
+	}
+	bytes, err := parseSizeArg(size)
+	if err != nil {
+		return err
+	}
+	info := vg.VGInfo()
+	if cache != nil {
+		var pvs []util.PVInfo
+		for _, pv := range info.PVs {
+			if !util.HasTag(pv.Tags, cache.PVTag) {
+				pvs = append(pvs, pv)
+			}
+		}
+		info.PVs = pvs
+	}
+	if layout.Fits(info, bytes) {
+		return nil
+	}
+	count, perPV := layout.PVRequirement(bytes)
+	return &CommandError{
+		Command:  "lvcreate",
+		Args:     []string{"--name", lvName, "--size", size, "--type", layout.Type, vg.Name},
+		ExitCode: -1,
+		Reason:   ReasonLayoutUnfit,
+		Err:      fmt.Errorf("%s LV needs %d PVs with %d bytes free each, VG %s doesn't have them", layout.Type, count, perPV, vg.Name),
+	}
+}
+
+// attachCache creates a cache pool on the PVs with the cache tag and
+// attaches it to the LV
+func (m *LVManager) attachCache(lvName, vgName, size string, cache *util.CacheOptions) error {
+	bytes, err := parseSizeArg(size)
+	if err != nil {
+		return err
+	}
+	poolName := lvName + "_cache"
+	segTypes, err := lvSegTypes(vgName)
+	if err != nil {
+		return err
+	}
+	if segTypes[lvName] == "cache" {
+		glog.Infof("LV %s/%s is already cached", vgName, lvName)
+		return nil
+	}
+	// the pool is left by a previous attempt failed to attach it
+	if _, ok := segTypes[poolName]; !ok {
+		cacheSize := fmt.Sprintf("%db", cache.CacheSize(bytes))
+		output, err := m.runLVMAudited("lvcreate", "--type", "cache-pool", "--name", poolName,
+			"--size", cacheSize, vgName, "@"+cache.PVTag)
+		if err != nil {
+			glog.Errorf("failed to create cache pool %s with size %s: %v", poolName, cacheSize, err)
+			return err
+		}
+		glog.Infof("lvcreate output: %s", output)
+	}
+	output, err := m.runLVMAudited("lvconvert", "--yes", "--type", "cache", "--cachemode", cache.Mode,
+		"--cachepool", vgName+"/"+poolName, vgName+"/"+lvName)
+	if err != nil {
+		glog.Errorf("failed to attach cache pool %s to LV %s: %v", poolName, lvName, err)
+		return err
+	}
+	glog.Infof("lvconvert output: %s", output)
+	return nil
+}
+
+// lvSegTypes returns the segment types of the visible LVs of the VG read
+// from LVM instead of the synced LVM status
+func lvSegTypes(vgName string) (map[string]string, error) {
+	output, err := runLVM("lvs", "--noheadings", "--separator", ",", "-o", "lv_name,segtype", vgName)
+	if err != nil {
+		glog.Errorf("failed to list LVs of VG %s: %v", vgName, err)
+		return nil, err
+	}
+	segTypes := map[string]string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) == 2 {
+			segTypes[fields[0]] = fields[1]
+		}
+	}
+	return segTypes, nil
+}
+
+// detachCache flushes dirty blocks to the origin LV and removes the cache pool
+func (m *LVManager) detachCache(lvName, vgName string) error {
+	output, err := m.runLVMAudited("lvconvert", "--yes", "--uncache", vgName+"/"+lvName)
+	if err != nil {
+		glog.Errorf("failed to uncache LV %s: %v", lvName, err)
+		return err
+	}
+	glog.Infof("lvconvert output: %s", output)
+	return nil
+}
+
+// CacheStats is the dm-cache statistics of a cached LV
+type CacheStats struct {
+	ReadHits    int64 `json:"readHits"`
+	ReadMisses  int64 `json:"readMisses"`
+	WriteHits   int64 `json:"writeHits"`
+	WriteMisses int64 `json:"writeMisses"`
+	DirtyBlocks int64 `json:"dirtyBlocks"`
+}
+
+func (m *LVManager) CacheStats(lvName, vgName string) (CacheStats, error) {
+	var stats CacheStats
+	cols := "cache_read_hits,cache_read_misses,cache_write_hits,cache_write_misses,cache_dirty_blocks"
+	output, err := runLVM("lvs", "--noheadings", "--separator", ",", "-o", cols, vgName+"/"+lvName)
+	if err != nil {
+		glog.Errorf("failed to get cache stats of LV %s: %v", lvName, err)
+		return stats, err
+	}
+	fields := strings.Split(strings.TrimSpace(string(output)), ",")
+	values := []*int64{&stats.ReadHits, &stats.ReadMisses, &stats.WriteHits, &stats.WriteMisses, &stats.DirtyBlocks}
+	if len(fields) != len(values) {
+		return stats, fmt.Errorf("unexpected cache stats of LV %s: %s", lvName, output)
+	}
+	for i, field := range fields {
+		if *values[i], err = strconv.ParseInt(strings.TrimSpace(field), 10, 64); err != nil {
+			return stats, fmt.Errorf("invalid cache stats of LV %s: %s", lvName, output)
+		}
+	}
+	return stats, nil
+}
+
+// VerifyLVOwner returns an error if the LV is tagged as owned by a PVC other
+// than uid, LVs without owner tags are provisioned before LVs were tagged
+// and are released with their PVs
+func (m *LVManager) VerifyLVOwner(lvName, vgName, uid string) error {
+	lv, ok := m.VGs()[vgName].LVs[lvName]
+	if !ok {
+		return nil
+	}
+	owner := util.LVOwnerUID(lv.Tags)
+	if owner == "" {
+		glog.Warningf("LV %s/%s has no owner tag, release it with its PV", vgName, lvName)
+		return nil
+	}
+	if uid != "" && owner != uid {
+		return fmt.Errorf("LV %s/%s is owned by PVC %s, not %s", vgName, lvName, owner, uid)
+	}
+	return nil
+}
+
+// VerifyLVReusable returns an error unless the existing LV is created for
+// the PVC uid, the manager tags the LVs it creates so a LV without owner
+// tags only shares the name and is never adopted, it would be erased
+func (m *LVManager) VerifyLVReusable(lvName, vgName, uid string) error {
+	lv, ok := m.VGs()[vgName].LVs[lvName]
+	if !ok {
+		return nil
+	}
+	return checkLVOwner(lvName, vgName, util.LVOwnerUID(lv.Tags), uid)
+}
+
+// checkLVOwner returns a non-retryable name conflict error unless the owner
+// of the existing LV is uid
+func checkLVOwner(lvName, vgName, owner, uid string) error {
+	var err error
+	switch {
+	case owner == "":
+		err = fmt.Errorf("LV %s/%s exists without owner tags, it's not created for PVC %s", vgName, lvName, uid)
+	case uid != "" && owner != uid:
+		err = fmt.Errorf("LV %s/%s is owned by PVC %s, not %s", vgName, lvName, owner, uid)
+	default:
+		return nil
+	}
+	return &CommandError{
+		Command:  "lvcreate",
+		Args:     []string{"--name", lvName, vgName},
+		ExitCode: -1,
+		Reason:   ReasonNameConflict,
+		Err:      err,
+	}
+}
+
+// verifyLVTags is VerifyLVReusable reading the owner tags from LVM instead
+// of the synced LVM status
+func verifyLVTags(lvName, vgName, uid string) error {
+	output, err := runLVM("lvs", "--noheadings", "-o", "lv_tags", vgName+"/"+lvName)
+	if err != nil {
+		return err
+	}
+	owner := util.LVOwnerUID(splitTags(strings.TrimSpace(string(output))))
+	if err := checkLVOwner(lvName, vgName, owner, uid); err != nil {
+		return err
+	}
+	glog.Infof("LV %s/%s already exists, reuse it", vgName, lvName)
+	return nil
+}
+
+// IsCached reports whether the LV has a cache pool attached
+func (m *LVManager) IsCached(lvName, vgName string) bool {
+	lv, ok := m.VGs()[vgName].LVs[lvName]
+	return ok && lv.SegType == "cache"
+}
+
+func (vg VolumeGroup) pvsWithoutTag(tag string) []string {
+	var pvs []string
+	for name, pv := range vg.PVs {
+		if !util.HasTag(pv.Tags, tag) {
+			pvs = append(pvs, name)
+		}
+	}
+	sort.Strings(pvs)
+	return pvs
+}
+
+// parseSizeArg parses a size given to lvcreate, either in bytes like 1024b
+// or a kubernetes quantity like 10Gi
+func parseSizeArg(size string) (int64, error) {
+	if strings.HasSuffix(size, "b") {
+		return strconv.ParseInt(strings.TrimSuffix(size, "b"), 10, 64)
+	}
+	q, err := resource.ParseQuantity(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s: %v", size, err)
+	}
+	return q.Value(), nil
+}
+
+// SignatureError is returned when a LV to be formatted already carries a
+// signature other than the expected filesystem
+type SignatureError struct {
+	Device   string
+	Found    string
+	Expected string
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("device %s already contains %s signature, refuse to format it to %s", e.Device, e.Found, e.Expected)
+}
+
+// FormatLV creates the filesystem on the LV. It's skipped if the LV already
+// has the filesystem and refused if it has any other signature, unless force
+// is set which wipes all the signatures first.
+func (m *LVManager) FormatLV(lvName, vgName string, fsType string, force bool) error {
+	devPath := getVolumePath(lvName, vgName)
+	signature, err := probeSignature(devPath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case signature == fsType && !force:
+		glog.Infof("LV %s is already formatted to %s, skip formatting", devPath, fsType)
+		return nil
+	case signature != "" && !force:
+		return &SignatureError{Device: devPath, Found: signature, Expected: fsType}
+	case signature != "":
+		glog.Warningf("force formatting LV %s with %s signature to %s", devPath, signature, fsType)
+		output, err := m.runAudited(nil, "wipefs", "--all", devPath)
+		if err != nil {
+			glog.Errorf("failed to wipe signatures of LV %s: %v", devPath, err)
+			return err
+		}
+		glog.Infof("wipefs output: %s", output)
+	}
+	output, err := m.runAudited(nil, "mkfs", "--type", fsType, devPath)
 	if err != nil {
 		glog.Errorf("failed to format LV %s to %s: %v", devPath, fsType, err)
 		return err
@@ -191,14 +555,42 @@ func (m *LVManager) FormatLV(lvName, vgName string, fsType string) error {
 	return nil
 }
 
+// probeSignature returns the filesystem, partition table or other type of
+// signature on the device, or empty string if there is none
+func probeSignature(devPath string) (string, error) {
+	output, err := runCommand(nil, "blkid", "--probe", "--output", "export", devPath)
+	if exitCode(err) == 2 { // no signature
+		return "", nil
+	}
+	if err != nil {
+		glog.Errorf("failed to probe signature of %s: %v", devPath, err)
+		return "", err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		for _, key := range []string{"TYPE=", "PTTYPE="} {
+			if strings.HasPrefix(line, key) {
+				return strings.TrimPrefix(line, key), nil
+			}
+		}
+	}
+	return "unknown", nil
+}
+
 func (m *LVManager) MountLV(lvName, vgName string) (string, error) {
 	mntPath := path.Join(m.BaseDir, lvName)
-	if err := os.MkdirAll(mntPath, os.ModeDir); err != nil {
+	if err := os.MkdirAll(mntPath, 0755); err != nil {
 		glog.Errorf("failed to create mount directory %s: %v", mntPath, err)
 		return "", err
 	}
-	devPath := getDevPath(lvName, vgName)
-	output, err := exec.Command("mount", devPath, mntPath).Output()
+	devPath := getVolumePath(lvName, vgName)
+	if source, ok := mountSource(mntPath); ok {
+		// a LV of the same name in another VG is mounted there
+		if !sameDevice(source, devPath) {
+			return "", fmt.Errorf("%s is mounted at %s instead of LV %s/%s", source, mntPath, vgName, lvName)
+		}
+		return mntPath, nil
+	}
+	output, err := m.runAudited(nil, "mount", devPath, mntPath)
 	if err != nil {
 		glog.Infof("failed to mount LV %s to %s: %v", devPath, mntPath, err)
 		return "", err
@@ -207,9 +599,42 @@ func (m *LVManager) MountLV(lvName, vgName string) (string, error) {
 	return mntPath, nil
 }
 
+// SetOwnership changes the owner and permission bits of the root of the
+// mounted filesystem of the LV
+func (m *LVManager) SetOwnership(lvName string, opts util.OwnershipOptions) error {
+	mntPath := path.Join(m.BaseDir, lvName)
+	if !isMounted(mntPath) {
+		return fmt.Errorf("LV %s is not mounted at %s", lvName, mntPath)
+	}
+	uid, gid, mode := opts.Owner()
+	if uid >= 0 || gid >= 0 {
+		start := time.Now()
+		err := os.Chown(mntPath, uid, gid)
+		m.audit("chown", []string{fmt.Sprintf("%d:%d", uid, gid), mntPath}, start, err)
+		if err != nil {
+			glog.Errorf("failed to chown %s to %d:%d: %v", mntPath, uid, gid, err)
+			return err
+		}
+	}
+	// chmod after chown which clears the setuid and setgid bits
+	if mode != 0 {
+		start := time.Now()
+		err := os.Chmod(mntPath, mode)
+		m.audit("chmod", []string{mode.String(), mntPath}, start, err)
+		if err != nil {
+			glog.Errorf("failed to chmod %s to %s: %v", mntPath, mode, err)
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *LVManager) UnmountLV(name string) error {
 	mntPath := path.Join(m.BaseDir, name)
-	output, err := exec.Command("umount", mntPath).Output()
+	if !isMounted(mntPath) {
+		return nil
+	}
+	output, err := m.runAudited(nil, "umount", mntPath)
 	if err != nil {
 		glog.Errorf("failed to umount LV %s: %v", name, err)
 		return err
@@ -219,8 +644,19 @@ func (m *LVManager) UnmountLV(name string) error {
 }
 
 func (m *LVManager) RemoveLV(lvName string, vgName string) error {
+	unlock, err := m.lockVG(vgName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer m.Inventory.Invalidate()
+	if m.IsCached(lvName, vgName) {
+		if err := m.detachCache(lvName, vgName); err != nil {
+			return err
+		}
+	}
 	devPath := getDevPath(lvName, vgName)
-	output, err := exec.Command("lvremove", devPath, "--yes").Output()
+	output, err := m.runLVMAudited("lvremove", devPath, "--yes")
 	if err != nil {
 		glog.Errorf("failed to remove LV %s: %v", devPath, err)
 		return err
@@ -260,6 +696,95 @@ func (m *LVManager) RemoveLV(lvName string, vgName string) error {
 // 	}
 // }
 
+func splitTags(tags string) []string {
+	var result []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag != "" {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// parseLVMSize parses sizes reported with `--units H`, e.g. <10.00G
+func parseLVMSize(size string) (int64, error) {
+	s := strings.TrimLeft(strings.TrimSpace(size), "<>")
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	unit := int64(1)
+	units := "BKMGTPE"
+	if i := strings.IndexByte(units, s[len(s)-1]); i >= 0 {
+		for ; i > 0; i-- {
+			unit *= 1000
+		}
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %s: %v", size, err)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// VGInfo returns the summary of the VG published to the node
+func (vg VolumeGroup) VGInfo() util.VGInfo {
+	info := util.VGInfo{Name: vg.Name, Tags: vg.Tags}
+	var err error
+	if info.Size, err = parseLVMSize(vg.Size); err != nil {
+		glog.Errorf("failed to parse size of vg %s: %v", vg.Name, err)
+	}
+	if info.Free, err = parseLVMSize(vg.Free); err != nil {
+		glog.Errorf("failed to parse free size of vg %s: %v", vg.Name, err)
+	}
+	for _, pv := range vg.PVs {
+		free, err := parseLVMSize(pv.Free)
+		if err != nil {
+			glog.Errorf("failed to parse free size of pv %s: %v", pv.Name, err)
+		}
+		info.PVs = append(info.PVs, util.PVInfo{Name: pv.Name, Tags: pv.Tags, Free: free})
+	}
+	return info
+}
+
+// isMounted reports whether something is mounted on the path
+func isMounted(mntPath string) bool {
+	_, ok := mountSource(mntPath)
+	return ok
+}
+
+// isLVMounted reports whether the LV is mounted on the path
+func isLVMounted(mntPath, lvName, vgName string) bool {
+	source, ok := mountSource(mntPath)
+	return ok && sameDevice(source, getVolumePath(lvName, vgName))
+}
+
+// mountSource returns the device mounted on the path
+func mountSource(mntPath string) (string, bool) {
+	data, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		glog.Errorf("failed to read /proc/mounts: %v", err)
+		return "", false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == mntPath {
+			return fields[0], true
+		}
+	}
+	return "", false
+}
+
+// sameDevice reports whether the device paths, e.g. /dev/vg/lv and
+// /dev/mapper/vg-lv, are the same block device
+func sameDevice(a, b string) bool {
+	var sa, sb syscall.Stat_t
+	if syscall.Stat(a, &sa) != nil || syscall.Stat(b, &sb) != nil {
+		return a == b
+	}
+	return sa.Mode&syscall.S_IFMT == syscall.S_IFBLK && sa.Rdev == sb.Rdev
+}
+
 func getDevPath(lvName, vgName string) string {
 	return path.Join(
 		"/dev/mapper",
@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"syscall"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/metrics"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"k8s.io/api/core/v1"
+)
+
+var (
+	pvcSyncTotal = metrics.NewCounterVec("lvm_manager_pvc_sync_total",
+		"Total number of PVC syncs by result", "result")
+
+	lvmCommandDuration = metrics.NewHistogramVec("lvm_manager_lvm_command_duration_seconds",
+		"Latency of LVM commands", metrics.DefBuckets, "command")
+	lvmCommandErrors = metrics.NewCounterVec("lvm_manager_lvm_command_errors_total",
+		"Total number of failed LVM commands", "command")
+	lvmCommandRetries = metrics.NewCounterVec("lvm_manager_lvm_command_retries_total",
+		"Total number of LVM commands retried on lock contention", "command")
+	lockWaitDuration = metrics.NewHistogramVec("lvm_manager_lock_wait_seconds",
+		"Time waiting for the VG lock in the manager or the host lock file", metrics.DefBuckets, "lock")
+
+	vgSizeBytes = metrics.NewGaugeVec("lvm_manager_vg_size_bytes",
+		"Size of the VG", "vg")
+	vgFreeBytes = metrics.NewGaugeVec("lvm_manager_vg_free_bytes",
+		"Free space of the VG", "vg")
+	vgLVCount = metrics.NewGaugeVec("lvm_manager_vg_lv_count",
+		"Number of LVs in the VG", "vg")
+
+	volumeCapacityBytes = metrics.NewGaugeVec("lvm_manager_volume_capacity_bytes",
+		"Capacity of the volume filesystem", "namespace", "persistentvolumeclaim", "vg")
+	volumeUsedBytes = metrics.NewGaugeVec("lvm_manager_volume_used_bytes",
+		"Used bytes of the volume filesystem", "namespace", "persistentvolumeclaim", "vg")
+	volumeAvailableBytes = metrics.NewGaugeVec("lvm_manager_volume_available_bytes",
+		"Bytes available to unprivileged users in the volume filesystem", "namespace", "persistentvolumeclaim", "vg")
+	volumeInodes = metrics.NewGaugeVec("lvm_manager_volume_inodes",
+		"Total inodes of the volume filesystem", "namespace", "persistentvolumeclaim", "vg")
+	volumeInodesUsed = metrics.NewGaugeVec("lvm_manager_volume_inodes_used",
+		"Used inodes of the volume filesystem", "namespace", "persistentvolumeclaim", "vg")
+)
+
+// reportVGMetrics sets the VG gauges after LVM status is synced
+func reportVGMetrics(vgs map[string]VolumeGroup) {
+	vgSizeBytes.Reset()
+	vgFreeBytes.Reset()
+	vgLVCount.Reset()
+	for name, vg := range vgs {
+		if size, err := parseLVMSize(vg.Size); err == nil {
+			vgSizeBytes.Set(float64(size), name)
+		}
+		if free, err := parseLVMSize(vg.Free); err == nil {
+			vgFreeBytes.Set(float64(free), name)
+		}
+		vgLVCount.Set(float64(len(vg.LVs)), name)
+	}
+}
+
+// collectVolumeStats sets the volume gauges from statfs of the mount points
+// of the PVCs provisioned on this node
+func (c *Controller) collectVolumeStats() {
+	gauges := []*metrics.GaugeVec{volumeCapacityBytes, volumeUsedBytes, volumeAvailableBytes, volumeInodes, volumeInodesUsed}
+	for _, g := range gauges {
+		g.Reset()
+	}
+	for _, obj := range c.store.List() {
+		pvc, ok := obj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			continue
+		}
+		ann := pvc.GetAnnotations()
+		hostPath := ann[util.AnnProvisionerHostPath]
+		if ann[util.AnnProvisionerNode] != c.nodeName || hostPath == "" {
+			continue
+		}
+		// statfs of an unmounted hostPath reads the filesystem below it
+		if !isLVMounted(hostPath, ann[util.AnnProvisionerLVName], ann[util.AnnProvisionerVGName]) {
+			continue
+		}
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(hostPath, &st); err != nil {
+			glog.Errorf("failed to statfs %s of pvc %s/%s: %v", hostPath, pvc.Namespace, pvc.Name, err)
+			continue
+		}
+		labels := []string{pvc.Namespace, pvc.Name, ann[util.AnnProvisionerVGName]}
+		bsize := float64(st.Bsize)
+		volumeCapacityBytes.Set(float64(st.Blocks)*bsize, labels...)
+		volumeUsedBytes.Set(float64(st.Blocks-st.Bfree)*bsize, labels...)
+		volumeAvailableBytes.Set(float64(st.Bavail)*bsize, labels...)
+		volumeInodes.Set(float64(st.Files), labels...)
+		volumeInodesUsed.Set(float64(st.Files-st.Ffree), labels...)
+	}
+}
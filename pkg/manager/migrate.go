@@ -0,0 +1,353 @@
+package manager
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// annotations set by the PV controller, they are not copied to the PV and
+// PVC recreated for a migrated volume
+var bindAnnotations = []string{
+	"pv.kubernetes.io/bind-completed",
+	"pv.kubernetes.io/bound-by-controller",
+}
+
+// migratePVC copies the volume of the PVC to the target node, then the PVC
+// is recreated and bound to the copy. The pods using the PVC must be stopped
+// and kept from being started again, e.g. by cordoning the node. It returns
+// what it's waiting for until the migration is done.
+func (c *Controller) migratePVC(pvc *v1.PersistentVolumeClaim, target string) (string, error) {
+	ns, name := pvc.Namespace, pvc.Name
+	ann := pvc.GetAnnotations()
+	if target == c.nodeName {
+		return "", fmt.Errorf("can't migrate PVC %s/%s to its own node", ns, name)
+	}
+	if util.EncryptionOptionsFromAnnotations(ann) != nil {
+		return "", fmt.Errorf("encrypted PVC %s/%s can't be migrated", ns, name)
+	}
+	pv, err := c.kubeCli.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if pv.Annotations[util.AnnProvisionerImported] == "true" {
+		return "", fmt.Errorf("PV %s of PVC %s/%s is imported, it can't be migrated", pv.Name, ns, name)
+	}
+	newPVName := migratedPVName(pv.Name, target)
+	newPV, err := c.kubeCli.CoreV1().PersistentVolumes().Get(newPVName, metav1.GetOptions{})
+	if err == nil {
+		return c.finishMigration(newPV)
+	}
+	if !apierr.IsNotFound(err) {
+		return "", err
+	}
+	pod, err := c.podUsingPVC(pvc)
+	if err != nil {
+		return "", err
+	}
+	if pod != "" {
+		return fmt.Sprintf("waiting for pod %s using PVC %s/%s to stop", pod, ns, name), nil
+	}
+
+	lvName, vgName := ann[util.AnnProvisionerLVName], ann[util.AnnProvisionerVGName]
+	size, err := c.lvm.LVSize(lvName, vgName)
+	if err != nil {
+		return "", err
+	}
+	layout, err := util.LVLayoutFromAnnotations(ann)
+	if err != nil {
+		return "", err
+	}
+	fsType, err := probeSignature(getVolumePath(lvName, vgName))
+	if err != nil {
+		return "", err
+	}
+	client, err := c.transferClient(target)
+	if err != nil {
+		return "", err
+	}
+	v, err := client.prepare(transferVolume{
+		PVCNamespace: ns,
+		PVCName:      name,
+		PVCUID:       string(pvc.UID),
+		PVName:       newPVName,
+		LVName:       lvName,
+		VGName:       vgName,
+		Size:         size,
+		Layout:       layout,
+		FSType:       fsType,
+	})
+	if err != nil {
+		return "", err
+	}
+	c.recordPVCEvent(pvc, v1.EventTypeNormal, "MigrationStarted", "copying LV %s/%s to node %s", vgName, lvName, target)
+	start := time.Now()
+	if err := client.send(v, ann[util.AnnProvisionerHostPath]); err != nil {
+		return "", fmt.Errorf("failed to copy LV %s/%s to node %s: %v", vgName, lvName, target, err)
+	}
+	// the copy is inconsistent if a pod has started during the copy
+	pod, err = c.podUsingPVC(pvc)
+	if err != nil {
+		return "", err
+	}
+	if pod != "" {
+		return fmt.Sprintf("pod %s started during the copy, waiting for it to stop", pod), client.abort(v)
+	}
+	c.recordPVCEvent(pvc, v1.EventTypeNormal, "MigrationCopied", "copied LV %s/%s to node %s in %v", vgName, lvName, target, time.Since(start))
+
+	newPV, err = c.migratedPV(pv, pvc, v, target)
+	if err != nil {
+		return "", err
+	}
+	newPV, err = c.kubeCli.CoreV1().PersistentVolumes().Create(newPV)
+	if err != nil {
+		return "", err
+	}
+	atomic.StoreInt32(&c.migrationsPending, 1)
+	return c.finishMigration(newPV)
+}
+
+// finishMigration replaces the PVC recorded in the migrated PV: the old PVC
+// is deleted, and recreated once its LV is released, then the LV on the
+// target node is handed over to the new PVC. It's resumed by the manager of
+// the source node after restart.
+func (c *Controller) finishMigration(pv *v1.PersistentVolume) (string, error) {
+	ann := pv.GetAnnotations()
+	if ann[util.AnnProvisionerMigrationClaim] == "" {
+		return "", nil
+	}
+	claim := &v1.PersistentVolumeClaim{}
+	if err := json.Unmarshal([]byte(ann[util.AnnProvisionerMigrationClaim]), claim); err != nil {
+		return "", fmt.Errorf("invalid migration claim of PV %s: %v", pv.Name, err)
+	}
+	ns, name := claim.Namespace, claim.Name
+	source, target := ann[util.AnnProvisionerMigratedFrom], ann[util.AnnProvisionerNode]
+	v := transferVolume{
+		PVCNamespace: ns,
+		PVCName:      name,
+		PVName:       pv.Name,
+		LVName:       ann[util.AnnProvisionerLVName],
+		VGName:       ann[util.AnnProvisionerVGName],
+		OwnerUID:     ann[util.AnnProvisionerMigrationOwner],
+	}
+	pvcs := c.kubeCli.CoreV1().PersistentVolumeClaims(ns)
+	pvc, err := pvcs.Get(name, metav1.GetOptions{})
+	switch {
+	case apierr.IsNotFound(err):
+		released, err := c.claimReleased(ns, name, source)
+		if err != nil || !released {
+			return fmt.Sprintf("waiting for LV of PVC %s/%s on node %s to be removed", ns, name, source), err
+		}
+		if _, err := pvcs.Create(claim); err != nil && !apierr.IsAlreadyExists(err) {
+			return "", err
+		}
+		return fmt.Sprintf("waiting for PVC %s/%s to be bound to PV %s", ns, name, pv.Name), nil
+	case err != nil:
+		return "", err
+	case pvc.Spec.VolumeName != pv.Name:
+		// the old PVC, no pod can start using it once it's being deleted
+		if pvc.DeletionTimestamp != nil {
+			return fmt.Sprintf("waiting for PVC %s/%s to be deleted", ns, name), nil
+		}
+		// the PVC is migrated or recreated on another node meanwhile
+		if pvc.Annotations[util.AnnProvisionerNode] != source {
+			return "", fmt.Errorf("PVC %s/%s is on node %s instead of %s, delete PV %s and its LV on node %s to give up the migration",
+				ns, name, pvc.Annotations[util.AnnProvisionerNode], source, pv.Name, target)
+		}
+		pod, err := c.podUsingPVC(pvc)
+		if err != nil {
+			return "", err
+		}
+		if pod != "" {
+			glog.Warningf("pod %s started using PVC %s/%s after it's copied, give up the copy", pod, ns, name)
+			if err := c.abortMigration(pv, pvc); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("pod %s started using PVC %s/%s, waiting for it to stop", pod, ns, name), nil
+		}
+		uid := pvc.UID
+		err = pvcs.Delete(name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+		if err != nil && !apierr.IsNotFound(err) {
+			return "", err
+		}
+		glog.Infof("deleted PVC %s/%s to rebind it to PV %s", ns, name, pv.Name)
+		return fmt.Sprintf("waiting for PVC %s/%s to be deleted", ns, name), nil
+	case pvc.Status.Phase != v1.ClaimBound:
+		return fmt.Sprintf("waiting for PVC %s/%s to be bound to PV %s", ns, name, pv.Name), nil
+	}
+
+	client, err := c.transferClient(target)
+	if err != nil {
+		return "", err
+	}
+	v.PVCUID = string(pvc.UID)
+	if err := client.commit(v); err != nil {
+		return "", err
+	}
+	delete(pv.Annotations, util.AnnProvisionerMigrationClaim)
+	delete(pv.Annotations, util.AnnProvisionerMigrationOwner)
+	if _, err := c.kubeCli.CoreV1().PersistentVolumes().Update(pv); err != nil {
+		return "", err
+	}
+	glog.Infof("migrated PVC %s/%s from node %s to node %s", ns, name, source, target)
+	c.recordPVCEvent(pvc, v1.EventTypeNormal, "Migrated", "migrated LV %s/%s from node %s to node %s", v.VGName, v.LVName, source, target)
+	return "", nil
+}
+
+// abortMigration removes the copy of the PVC and its PV
+func (c *Controller) abortMigration(pv *v1.PersistentVolume, pvc *v1.PersistentVolumeClaim) error {
+	client, err := c.transferClient(pv.Annotations[util.AnnProvisionerNode])
+	if err != nil {
+		return err
+	}
+	err = client.abort(transferVolume{
+		PVCNamespace: pvc.Namespace,
+		PVCName:      pvc.Name,
+		PVCUID:       string(pvc.UID),
+		PVName:       pv.Name,
+		LVName:       pv.Annotations[util.AnnProvisionerLVName],
+		VGName:       pv.Annotations[util.AnnProvisionerVGName],
+	})
+	if err != nil {
+		return err
+	}
+	err = c.kubeCli.CoreV1().PersistentVolumes().Delete(pv.Name, &metav1.DeleteOptions{})
+	if err != nil && !apierr.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// resumeMigrations finishes the migrations from this node interrupted by
+// restart, and records whether any of them is still unfinished
+func (c *Controller) resumeMigrations(pvs []v1.PersistentVolume) {
+	var pending int32
+	for i := range pvs {
+		pv := &pvs[i]
+		ann := pv.GetAnnotations()
+		if ann[util.AnnProvisionerMigratedFrom] != c.nodeName || ann[util.AnnProvisionerMigrationClaim] == "" {
+			continue
+		}
+		waiting, err := c.finishMigration(pv)
+		if err != nil {
+			glog.Errorf("failed to finish migration of PV %s: %v", pv.Name, err)
+			pending = 1
+		} else if waiting != "" {
+			glog.Infof("migration of PV %s is %s", pv.Name, waiting)
+			pending = 1
+		}
+	}
+	atomic.StoreInt32(&c.migrationsPending, pending)
+}
+
+// claimReleased reports whether the LV of the deleted PVC is removed from
+// the node
+func (c *Controller) claimReleased(ns, name, node string) (bool, error) {
+	pvs, err := c.kubeCli.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, pv := range pvs.Items {
+		ref, ann := pv.Spec.ClaimRef, pv.GetAnnotations()
+		if ref != nil && ref.Namespace == ns && ref.Name == name &&
+			ann[util.AnnProvisionerNode] == node && ann[util.AnnProvisionerLVDeleted] != "true" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// podUsingPVC returns the name of a pod which uses the PVC and isn't
+// terminated
+func (c *Controller) podUsingPVC(pvc *v1.PersistentVolumeClaim) (string, error) {
+	pods, err := c.kubeCli.CoreV1().Pods(pvc.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvc.Name {
+				return pod.Name, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// migratedPVName returns the name of the PV a volume is copied to, it's
+// stable so that an interrupted migration can be resumed
+func migratedPVName(pvName, target string) string {
+	sum := sha1.Sum([]byte(pvName + "/" + target))
+	suffix := fmt.Sprintf("-%x", sum[:4])
+	if len(pvName)+len(suffix) > 253 {
+		pvName = pvName[:253-len(suffix)]
+	}
+	return pvName + suffix
+}
+
+// migratedPV returns the PV of the copy of the volume, pre-bound to the PVC
+// recreated from the migration claim
+func (c *Controller) migratedPV(pv *v1.PersistentVolume, pvc *v1.PersistentVolumeClaim, v transferVolume, target string) (*v1.PersistentVolume, error) {
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pvc.Name,
+			Namespace:       pvc.Namespace,
+			Labels:          pvc.Labels,
+			Annotations:     map[string]string{},
+			OwnerReferences: pvc.OwnerReferences,
+		},
+		Spec: *pvc.Spec.DeepCopy(),
+	}
+	for key, value := range pvc.Annotations {
+		claim.Annotations[key] = value
+	}
+	claim.Annotations[util.AnnProvisionerNode] = target
+	claim.Annotations[util.AnnProvisionerHostPath] = v.HostPath
+	claim.Annotations[util.AnnProvisionerVGName] = v.VGName
+	for _, key := range bindAnnotations {
+		delete(claim.Annotations, key)
+	}
+	claim.Spec.VolumeName = v.PVName
+	claimData, err := json.Marshal(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	newPV := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        v.PVName,
+			Labels:      pv.Labels,
+			Annotations: map[string]string{},
+		},
+		Spec: *pv.Spec.DeepCopy(),
+	}
+	for key, value := range pv.Annotations {
+		newPV.Annotations[key] = value
+	}
+	for _, key := range bindAnnotations {
+		delete(newPV.Annotations, key)
+	}
+	delete(newPV.Annotations, util.AnnProvisionerLVDeleted)
+	newPV.Annotations[util.AnnProvisionerNode] = target
+	newPV.Annotations[util.AnnProvisionerHostPath] = v.HostPath
+	newPV.Annotations[util.AnnProvisionerVGName] = v.VGName
+	newPV.Annotations[util.AnnProvisionerMigratedFrom] = c.nodeName
+	newPV.Annotations[util.AnnProvisionerMigrationClaim] = string(claimData)
+	newPV.Annotations[util.AnnProvisionerMigrationOwner] = string(pvc.UID)
+	newPV.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: *resource.NewQuantity(v.Size, resource.BinarySI)}
+	newPV.Spec.HostPath = &v1.HostPathVolumeSource{Path: v.HostPath}
+	newPV.Spec.ClaimRef = &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: pvc.Namespace, Name: pvc.Name}
+	return newPV, nil
+}
@@ -0,0 +1,552 @@
+package manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+)
+
+// TransferOptions configures the transfer of volumes between the managers
+// of different nodes
+type TransferOptions struct {
+	// Token authenticates the managers to each other
+	Token string
+	// Port is the port of the transfer server of every manager
+	Port int
+	// PodSelector is the label selector of the manager pods
+	PodSelector string
+	// TLSConfig verifies the transfer servers of the other managers
+	TLSConfig *tls.Config
+}
+
+const (
+	// transferCallTimeout bounds the calls which don't copy data, e.g.
+	// mounting or committing the LV
+	transferCallTimeout = 10 * time.Minute
+	// transferMinThroughput is the slowest rate in bytes per second a
+	// volume is copied or checksummed at before the call is given up
+	transferMinThroughput = 1 << 20
+)
+
+// transferTimeout is the deadline of a call copying or checksumming size
+// bytes
+func transferTimeout(size int64) time.Duration {
+	return transferCallTimeout + time.Duration(size/transferMinThroughput)*time.Second
+}
+
+// transferVolume is the LV a volume is copied to on the target node
+type transferVolume struct {
+	PVCNamespace string        `json:"pvcNamespace"`
+	PVCName      string        `json:"pvcName"`
+	PVCUID       string        `json:"pvcUID"`
+	PVName       string        `json:"pvName"`
+	LVName       string        `json:"lvName"`
+	VGName       string        `json:"vgName"`
+	Size         int64         `json:"size"`
+	Layout       util.LVLayout `json:"layout"`
+	FSType       string        `json:"fsType"`
+	// OwnerUID is the source PVC owning the LV until it's committed to PVCUID
+	OwnerUID string `json:"ownerUID,omitempty"`
+	// HostPath is where the LV is mounted on the target node
+	HostPath string `json:"hostPath,omitempty"`
+	// Block is set if the blocks of the LV are copied instead of the files,
+	// the LV is neither formatted nor mounted when it's prepared
+	Block bool `json:"block,omitempty"`
+}
+
+func (v transferVolume) operation(trigger string) Operation {
+	return Operation{
+		Trigger:      trigger,
+		PVCNamespace: v.PVCNamespace,
+		PVCName:      v.PVCName,
+		PVName:       v.PVName,
+		VGName:       v.VGName,
+		LVName:       v.LVName,
+	}
+}
+
+// ServeTransfer registers the handlers receiving volumes from the managers
+// of other nodes, and enables sending volumes to them
+func (c *Controller) ServeTransfer(mux *http.ServeMux, opts TransferOptions) {
+	c.transfer = &opts
+	c.transferHTTP = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:     opts.TLSConfig,
+			DialContext:         (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	mux.HandleFunc("/transfer/prepare", c.transferHandler(c.prepareTransfer))
+	mux.HandleFunc("/transfer/data", c.transferHandler(c.receiveTransfer))
+	mux.HandleFunc("/transfer/commit", c.transferHandler(c.commitTransfer))
+	mux.HandleFunc("/transfer/abort", c.transferHandler(c.abortTransfer))
+	mux.HandleFunc("/transfer/block", c.transferHandler(c.receiveBlock))
+	mux.HandleFunc("/transfer/verify", c.transferHandler(c.verifyBlocks))
+	mux.HandleFunc("/transfer/mount", c.transferHandler(c.mountTransfer))
+}
+
+func (c *Controller) transferHandler(handle func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+c.transfer.Token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := handle(r)
+		if err != nil {
+			glog.Errorf("failed to handle %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func decodeTransferVolume(r *http.Request) (transferVolume, error) {
+	var v transferVolume
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		return v, fmt.Errorf("invalid transfer volume: %v", err)
+	}
+	return v, nil
+}
+
+// prepareTransfer allocates, formats and mounts the LV receiving the volume,
+// the LV is owned by the source PVC until the transfer is committed
+func (c *Controller) prepareTransfer(r *http.Request) (interface{}, error) {
+	v, err := decodeTransferVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	if c.Decommissioning() {
+		return nil, fmt.Errorf("node %s is being decommissioned", c.nodeName)
+	}
+	lvm := c.lvm.WithOperation(v.operation("migration"))
+	tags := util.LVOwnerTags(v.PVCNamespace, v.PVCName, v.PVCUID)
+	if err := lvm.AllocateLV(v.LVName, v.VGName, fmt.Sprintf("%db", v.Size), v.Layout, nil, tags); err != nil {
+		return nil, err
+	}
+	if v.Block {
+		glog.Infof("prepared LV %s/%s for blocks of PVC %s/%s", v.VGName, v.LVName, v.PVCNamespace, v.PVCName)
+		return v, nil
+	}
+	if err := lvm.FormatLV(v.LVName, v.VGName, v.FSType, false); err != nil {
+		return nil, err
+	}
+	hostPath, err := lvm.MountLV(v.LVName, v.VGName)
+	if err != nil {
+		return nil, err
+	}
+	v.HostPath = hostPath
+	glog.Infof("prepared LV %s/%s at %s for PVC %s/%s", v.VGName, v.LVName, hostPath, v.PVCNamespace, v.PVCName)
+	return v, nil
+}
+
+// receiveTransfer extracts the tar stream of the volume into the LV
+func (c *Controller) receiveTransfer(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	lvName, vgName := query.Get("lv"), query.Get("vg")
+	if err := c.preparedLV(lvName, vgName, query.Get("uid")); err != nil {
+		return nil, err
+	}
+	mntPath := path.Join(c.lvm.BaseDir, lvName)
+	if !isMounted(mntPath) {
+		return nil, fmt.Errorf("LV %s/%s is not mounted at %s", vgName, lvName, mntPath)
+	}
+	lvm := c.lvm.WithOperation(Operation{Trigger: "migration", VGName: vgName, LVName: lvName})
+	args := []string{"--extract", "--preserve-permissions", "--numeric-owner", "--no-overwrite-dir", "--directory", mntPath, "--file", "-"}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// tar only sees the members checked to stay under the mount point
+	pr, pw := io.Pipe()
+	checked := make(chan error, 1)
+	go func() {
+		err := copyTarMembers(pw, r.Body)
+		if err != nil {
+			cancel()
+		}
+		pw.CloseWithError(err)
+		checked <- err
+	}()
+	start := time.Now()
+	err := runCommandStream(ctx, pr, ioutil.Discard, "tar", args...)
+	// unblocks the check if tar exited early
+	pr.Close()
+	if checkErr := <-checked; checkErr != nil && checkErr != io.ErrClosedPipe {
+		err = checkErr
+	}
+	lvm.audit("tar", args, start, err)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("received LV %s/%s in %v", vgName, lvName, time.Since(start))
+	return map[string]string{}, nil
+}
+
+// copyTarMembers copies the tar stream member by member, the stream is
+// rejected once a member or a hard link target is an absolute path or
+// contains ..
+func copyTarMembers(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkTarPath(hdr.Name); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			if err := checkTarPath(hdr.Linkname); err != nil {
+				return err
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func checkTarPath(name string) error {
+	if path.IsAbs(name) {
+		return fmt.Errorf("absolute path %s in tar stream", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return fmt.Errorf("path %s in tar stream contains ..", name)
+		}
+	}
+	return nil
+}
+
+// preparedLV returns an error unless the LV is prepared for the PVC uid
+func (c *Controller) preparedLV(lvName, vgName, uid string) error {
+	lv, ok := c.lvm.VGs()[vgName].LVs[lvName]
+	if !ok || uid == "" || util.LVOwnerUID(lv.Tags) != uid {
+		return fmt.Errorf("LV %s/%s is not prepared for PVC %s", vgName, lvName, uid)
+	}
+	return nil
+}
+
+// receiveBlock writes a chunk of the volume to the LV at the offset once its
+// checksum is verified
+func (c *Controller) receiveBlock(r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	lvName, vgName := query.Get("lv"), query.Get("vg")
+	if err := c.preparedLV(lvName, vgName, query.Get("uid")); err != nil {
+		return nil, err
+	}
+	// writing the blocks under a mounted filesystem corrupts it
+	if isMounted(path.Join(c.lvm.BaseDir, lvName)) {
+		return nil, fmt.Errorf("LV %s/%s is mounted, refuse to write blocks", vgName, lvName)
+	}
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("invalid offset %s", query.Get("offset"))
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, blockChunkSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > blockChunkSize {
+		return nil, fmt.Errorf("chunk is larger than %d bytes", blockChunkSize)
+	}
+	if sum := checksum(data); sum != query.Get("sha256") {
+		return nil, fmt.Errorf("checksum %s of chunk at %d doesn't match %s", sum, offset, query.Get("sha256"))
+	}
+	dev, err := os.OpenFile(getDevPath(lvName, vgName), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+	if _, err := dev.WriteAt(data, offset); err != nil {
+		return nil, err
+	}
+	return map[string]string{}, dev.Sync()
+}
+
+// verifyBlocks returns the checksums of the chunks of the LV
+func (c *Controller) verifyBlocks(r *http.Request) (interface{}, error) {
+	v, err := decodeTransferVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.preparedLV(v.LVName, v.VGName, v.PVCUID); err != nil {
+		return nil, err
+	}
+	return blockChecksums(getDevPath(v.LVName, v.VGName), v.Size)
+}
+
+// mountTransfer mounts the LV whose blocks are copied
+func (c *Controller) mountTransfer(r *http.Request) (interface{}, error) {
+	v, err := decodeTransferVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.preparedLV(v.LVName, v.VGName, v.PVCUID); err != nil {
+		return nil, err
+	}
+	hostPath, err := c.lvm.WithOperation(v.operation("migration")).MountLV(v.LVName, v.VGName)
+	if err != nil {
+		return nil, err
+	}
+	v.HostPath = hostPath
+	return v, nil
+}
+
+// commitTransfer hands the LV over to the PVC recreated on the target node,
+// the LV must still be owned by the source PVC
+func (c *Controller) commitTransfer(r *http.Request) (interface{}, error) {
+	v, err := decodeTransferVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	if lv, ok := c.lvm.VGs()[v.VGName].LVs[v.LVName]; ok && v.PVCUID != "" && util.LVOwnerUID(lv.Tags) == v.PVCUID {
+		// committed before the source failed to record it
+		return map[string]string{}, nil
+	}
+	if err := c.preparedLV(v.LVName, v.VGName, v.OwnerUID); err != nil {
+		return nil, err
+	}
+	lvm := c.lvm.WithOperation(v.operation("migration"))
+	return map[string]string{}, lvm.SetLVOwner(v.LVName, v.VGName, v.PVCNamespace, v.PVCName, v.PVCUID)
+}
+
+// abortTransfer removes the LV prepared for a transfer which is given up
+func (c *Controller) abortTransfer(r *http.Request) (interface{}, error) {
+	v, err := decodeTransferVolume(r)
+	if err != nil {
+		return nil, err
+	}
+	lv, ok := c.lvm.VGs()[v.VGName].LVs[v.LVName]
+	if !ok {
+		return map[string]string{}, nil
+	}
+	if util.LVOwnerUID(lv.Tags) != v.PVCUID {
+		return nil, fmt.Errorf("LV %s/%s is not prepared for PVC %s/%s", v.VGName, v.LVName, v.PVCNamespace, v.PVCName)
+	}
+	lvm := c.lvm.WithOperation(v.operation("migration-aborted"))
+	if err := lvm.UnmountLV(v.LVName); err != nil {
+		return nil, err
+	}
+	return map[string]string{}, lvm.RemoveLV(v.LVName, v.VGName)
+}
+
+// SetLVOwner replaces the owner tags of the LV
+func (m *LVManager) SetLVOwner(lvName, vgName, ns, name, uid string) error {
+	unlock, err := m.lockVG(vgName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer m.Inventory.Invalidate()
+	lv, ok := m.VGs()[vgName].LVs[lvName]
+	if !ok {
+		return fmt.Errorf("no LV %s/%s", vgName, lvName)
+	}
+	var args []string
+	for _, tag := range lv.Tags {
+		if util.IsLVOwnerTag(tag) {
+			args = append(args, "--deltag", tag)
+		}
+	}
+	for _, tag := range util.LVOwnerTags(ns, name, uid) {
+		args = append(args, "--addtag", tag)
+	}
+	args = append(args, vgName+"/"+lvName)
+	output, err := m.runLVMAudited("lvchange", args...)
+	if err != nil {
+		glog.Errorf("failed to change owner of LV %s/%s to PVC %s/%s: %v", vgName, lvName, ns, name, err)
+		return err
+	}
+	glog.Infof("lvchange output: %s", output)
+	return nil
+}
+
+// transferClient sends volumes to the manager of another node
+type transferClient struct {
+	node   string
+	url    string
+	token  string
+	client *http.Client
+}
+
+// transferClient returns the client of the manager running on the node
+func (c *Controller) transferClient(node string) (*transferClient, error) {
+	if c.transfer == nil {
+		return nil, fmt.Errorf("volume transfer is disabled, the transfer token is not set")
+	}
+	pods, err := c.kubeCli.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{
+		LabelSelector: c.transfer.PodSelector,
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning && pod.Status.PodIP != "" {
+			return &transferClient{
+				node:   node,
+				url:    fmt.Sprintf("https://%s", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(c.transfer.Port))),
+				token:  c.transfer.Token,
+				client: c.transferHTTP,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("no running manager pod matching %s on node %s", c.transfer.PodSelector, node)
+}
+
+// call gives up the request after the timeout, copying a volume may take
+// hours so it's set per call
+func (t *transferClient) call(method, uri string, body io.Reader, timeout time.Duration, result interface{}) error {
+	req, err := http.NewRequest(method, t.url+uri, body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s of node %s: %s: %s", method, uri, t.node, resp.Status, bytes.TrimSpace(msg))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (t *transferClient) post(uri string, v transferVolume, timeout time.Duration, result interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.call(http.MethodPost, uri, bytes.NewReader(data), timeout, result)
+}
+
+// prepare may format the whole LV
+func (t *transferClient) prepare(v transferVolume) (transferVolume, error) {
+	var prepared transferVolume
+	err := t.post("/transfer/prepare", v, transferTimeout(v.Size), &prepared)
+	return prepared, err
+}
+
+// send streams the files under hostPath to the prepared LV
+func (t *transferClient) send(v transferVolume, hostPath string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pr, pw := io.Pipe()
+	go func() {
+		err := runCommandStream(ctx, nil, pw, "tar", "--create", "--numeric-owner", "--directory", hostPath, "--file", "-", ".")
+		pw.CloseWithError(err)
+	}()
+	query := url.Values{"lv": {v.LVName}, "vg": {v.VGName}, "uid": {v.PVCUID}}
+	err := t.call(http.MethodPut, "/transfer/data?"+query.Encode(), pr, transferTimeout(v.Size), nil)
+	// stops tar if the request failed
+	pr.CloseWithError(err)
+	return err
+}
+
+// sendBlock writes the chunk to the prepared LV at the offset
+func (t *transferClient) sendBlock(v transferVolume, offset int64, data []byte) error {
+	query := url.Values{
+		"lv":     {v.LVName},
+		"vg":     {v.VGName},
+		"uid":    {v.PVCUID},
+		"offset": {strconv.FormatInt(offset, 10)},
+		"sha256": {checksum(data)},
+	}
+	return t.call(http.MethodPut, "/transfer/block?"+query.Encode(), bytes.NewReader(data), transferTimeout(int64(len(data))), nil)
+}
+
+// verify returns the checksums of the chunks of the prepared LV
+func (t *transferClient) verify(v transferVolume) ([]string, error) {
+	var sums []string
+	err := t.post("/transfer/verify", v, transferTimeout(v.Size), &sums)
+	return sums, err
+}
+
+func (t *transferClient) mount(v transferVolume) (transferVolume, error) {
+	var mounted transferVolume
+	err := t.post("/transfer/mount", v, transferCallTimeout, &mounted)
+	return mounted, err
+}
+
+func (t *transferClient) commit(v transferVolume) error {
+	return t.post("/transfer/commit", v, transferCallTimeout, nil)
+}
+
+func (t *transferClient) abort(v transferVolume) error {
+	return t.post("/transfer/abort", v, transferCallTimeout, nil)
+}
+
+// blockChunkSize is the size of the chunks the blocks of volumes are copied
+// and verified in
+const blockChunkSize = 64 << 20
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// blockChecksums returns the checksums of the chunks of the first size bytes
+// of the device
+func blockChecksums(devPath string, size int64) ([]string, error) {
+	dev, err := os.Open(devPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+	sums := []string{}
+	buf := make([]byte, blockChunkSize)
+	for offset := int64(0); offset < size; offset += blockChunkSize {
+		n := size - offset
+		if n > blockChunkSize {
+			n = blockChunkSize
+		}
+		if _, err := dev.ReadAt(buf[:n], offset); err != nil {
+			return nil, fmt.Errorf("failed to read %s at %d: %v", devPath, offset, err)
+		}
+		sums = append(sums, checksum(buf[:n]))
+	}
+	return sums, nil
+}
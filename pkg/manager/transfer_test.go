@@ -0,0 +1,132 @@
+package manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type tarMember struct {
+	hdr  tar.Header
+	data string
+}
+
+func writeTar(t *testing.T, members []tarMember) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		hdr := m.hdr
+		hdr.Size = int64(len(m.data))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("failed to write header of %s: %v", hdr.Name, err)
+		}
+		if _, err := tw.Write([]byte(m.data)); err != nil {
+			t.Fatalf("failed to write %s: %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func readTar(t *testing.T, data []byte) []tarMember {
+	var members []tarMember
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(tr); err != nil {
+			t.Fatalf("failed to read %s: %v", hdr.Name, err)
+		}
+		members = append(members, tarMember{
+			hdr:  tar.Header{Name: hdr.Name, Linkname: hdr.Linkname, Typeflag: hdr.Typeflag, Mode: hdr.Mode, Uid: hdr.Uid, Gid: hdr.Gid},
+			data: buf.String(),
+		})
+	}
+	return members
+}
+
+func TestCopyTarMembers(t *testing.T) {
+	clean := []tarMember{
+		{hdr: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "./data/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000}},
+		{hdr: tar.Header{Name: "./data/a..b", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000}, data: "abc"},
+		{hdr: tar.Header{Name: "./data/link", Typeflag: tar.TypeLink, Linkname: "./data/a..b"}},
+		{hdr: tar.Header{Name: "./data/symlink", Typeflag: tar.TypeSymlink, Linkname: "../data/a..b"}},
+	}
+	tests := []struct {
+		name    string
+		members []tarMember
+		err     bool
+	}{
+		{name: "clean", members: clean},
+		{name: "absolute", members: []tarMember{{hdr: tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg}, data: "x"}}, err: true},
+		{name: "parent", members: []tarMember{{hdr: tar.Header{Name: "../etc/passwd", Typeflag: tar.TypeReg}, data: "x"}}, err: true},
+		{name: "nested parent", members: []tarMember{{hdr: tar.Header{Name: "a/../../b", Typeflag: tar.TypeReg}, data: "x"}}, err: true},
+		{name: "trailing parent", members: []tarMember{{hdr: tar.Header{Name: "a/..", Typeflag: tar.TypeDir}}}, err: true},
+		{
+			name: "hard link to parent",
+			members: []tarMember{
+				{hdr: tar.Header{Name: "./a", Typeflag: tar.TypeReg}, data: "x"},
+				{hdr: tar.Header{Name: "./b", Typeflag: tar.TypeLink, Linkname: "../../etc/shadow"}},
+			},
+			err: true,
+		},
+		{
+			name:    "hard link to absolute path",
+			members: []tarMember{{hdr: tar.Header{Name: "./b", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}}},
+			err:     true,
+		},
+		{
+			name: "rejected after clean members",
+			members: append(append([]tarMember{}, clean...),
+				tarMember{hdr: tar.Header{Name: "./data/../../escape", Typeflag: tar.TypeReg}, data: "x"}),
+			err: true,
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := copyTarMembers(&out, bytes.NewReader(writeTar(t, test.members)))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expect error, got nil", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got := readTar(t, out.Bytes()); !reflect.DeepEqual(got, test.members) {
+			t.Errorf("%s: expect members %+v, got %+v", test.name, test.members, got)
+		}
+	}
+}
+
+func TestCheckTarPath(t *testing.T) {
+	tests := []struct {
+		name string
+		err  bool
+	}{
+		{name: "."},
+		{name: "./"},
+		{name: "a/b/c"},
+		{name: "./a..b/..c"},
+		{name: "/", err: true},
+		{name: "/a", err: true},
+		{name: "..", err: true},
+		{name: "../a", err: true},
+		{name: "a/../../b", err: true},
+		{name: "./a/..", err: true},
+	}
+	for _, test := range tests {
+		if err := checkTarPath(test.name); (err != nil) != test.err {
+			t.Errorf("%s: expect error %v, got %v", test.name, test.err, err)
+		}
+	}
+}
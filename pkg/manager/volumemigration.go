@@ -0,0 +1,622 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/util"
+	"golang.org/x/sys/unix"
+	"k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	volumeMigrationInterval = 10 * time.Second
+	volumeMigrationVersion  = "v1alpha1"
+	// the progress of a copy is saved at this interval, the copy is resumed
+	// from there after restart
+	migrationProgressInterval = 30 * time.Second
+	// maxVerifyAttempts is how many times the chunks differing from the
+	// source are copied again before the migration fails
+	maxVerifyAttempts = 3
+)
+
+// phases of VolumeMigrations
+const (
+	// MigrationPending waits for the pods using the PVC to stop
+	MigrationPending = "Pending"
+	// MigrationCopying copies the blocks of the LV to the target node
+	MigrationCopying = "Copying"
+	// MigrationVerifying compares the checksums of the chunks on both nodes
+	MigrationVerifying = "Verifying"
+	// MigrationRebinding recreates the PVC bound to the verified copy
+	MigrationRebinding = "Rebinding"
+	MigrationSucceeded = "Succeeded"
+	MigrationFailed    = "Failed"
+)
+
+// VolumeMigration moves the volume of a PVC to another node, the blocks of
+// the LV are copied in checksummed chunks and the PVC is rebound to the copy
+// once all the chunks are verified
+type VolumeMigration struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              VolumeMigrationSpec   `json:"spec"`
+	Status            VolumeMigrationStatus `json:"status,omitempty"`
+}
+
+type VolumeMigrationSpec struct {
+	// PVCName is the PVC in the namespace of the migration
+	PVCName    string `json:"pvcName"`
+	TargetNode string `json:"targetNode"`
+	// TargetVG defaults to the VG of the LV on the source node
+	TargetVG string `json:"targetVG,omitempty"`
+}
+
+// VolumeMigrationStatus is merge patched as a whole, its fields are never
+// omitted so that they can be reset
+type VolumeMigrationStatus struct {
+	Phase      string `json:"phase"`
+	SourceNode string `json:"sourceNode"`
+	// PVCUID owns the LV on the target node until the PVC is rebound
+	PVCUID string `json:"pvcUID"`
+	// VolumeName is the PV of the copy
+	VolumeName string `json:"volumeName"`
+	LVName     string `json:"lvName"`
+	// VGName is the VG of the copy on the target node
+	VGName     string `json:"vgName"`
+	TotalBytes int64  `json:"totalBytes"`
+	// CopiedBytes is where the copy is resumed from
+	CopiedBytes int64 `json:"copiedBytes"`
+	// Checksum is the sha256 of the checksums of the verified chunks
+	Checksum       string    `json:"checksum"`
+	Attempts       int       `json:"attempts"`
+	Message        string    `json:"message"`
+	LastUpdateTime time.Time `json:"lastUpdateTime"`
+}
+
+type volumeMigrationList struct {
+	Items []VolumeMigration `json:"items"`
+}
+
+func migrationDone(phase string) bool {
+	return phase == MigrationSucceeded || phase == MigrationFailed
+}
+
+func (c *Controller) volumeMigrationPath(ns, name string) string {
+	p := "/apis/" + util.StorageGroup(c.domainName) + "/" + volumeMigrationVersion
+	if ns != "" {
+		p += "/namespaces/" + ns
+	}
+	p += "/volumemigrations"
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+// volumeMigrationFinalizer keeps a cancelled migration until the copy is
+// removed from the target node
+func (c *Controller) volumeMigrationFinalizer() string {
+	return util.StorageGroup(c.domainName) + "/volume-migration"
+}
+
+func (c *Controller) listVolumeMigrations() ([]VolumeMigration, error) {
+	data, err := c.kubeCli.CoreV1().RESTClient().Get().AbsPath(c.volumeMigrationPath("", "")).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	var list volumeMigrationList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid volume migrations: %v", err)
+	}
+	return list.Items, nil
+}
+
+// saveVolumeMigration patches the status of the migration, the finalizer is
+// kept until the migration is done
+func (c *Controller) saveVolumeMigration(m *VolumeMigration, status VolumeMigrationStatus) error {
+	finalizer := c.volumeMigrationFinalizer()
+	var finalizers []string
+	has := false
+	for _, f := range m.Finalizers {
+		if f == finalizer {
+			has = true
+			continue
+		}
+		finalizers = append(finalizers, f)
+	}
+	want := !migrationDone(status.Phase)
+	status.LastUpdateTime = m.Status.LastUpdateTime
+	if status == m.Status && has == want {
+		return nil
+	}
+	status.LastUpdateTime = time.Now()
+	patch := map[string]interface{}{"status": status}
+	if has != want {
+		if want {
+			finalizers = append(finalizers, finalizer)
+		}
+		patch["metadata"] = map[string]interface{}{
+			"resourceVersion": m.ResourceVersion,
+			"finalizers":      finalizers,
+		}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	result, err := c.kubeCli.CoreV1().RESTClient().Patch(types.MergePatchType).
+		AbsPath(c.volumeMigrationPath(m.Namespace, m.Name)).Body(data).DoRaw()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(result, m)
+}
+
+// activeVolumeMigrations returns the PVCs being migrated from this node
+func (c *Controller) activeVolumeMigrations() map[string]bool {
+	active := map[string]bool{}
+	migrations, err := c.listVolumeMigrations()
+	if err != nil {
+		if !apierr.IsNotFound(err) {
+			glog.Errorf("failed to list volume migrations: %v", err)
+		}
+		return active
+	}
+	for _, m := range migrations {
+		if m.Status.SourceNode == c.nodeName && m.Status.Phase != MigrationPending && !migrationDone(m.Status.Phase) {
+			active[m.Namespace+"/"+m.Spec.PVCName] = true
+		}
+	}
+	return active
+}
+
+// syncVolumeMigrations drives the migrations of the PVCs on this node
+func (c *Controller) syncVolumeMigrations() {
+	migrations, err := c.listVolumeMigrations()
+	if apierr.IsNotFound(err) {
+		// the VolumeMigration CRD is not installed
+		return
+	}
+	if err != nil {
+		glog.Errorf("failed to list volume migrations: %v", err)
+		return
+	}
+	for i := range migrations {
+		m := &migrations[i]
+		if !c.ownsVolumeMigration(m) {
+			continue
+		}
+		status := m.Status
+		if !migrationDone(status.Phase) {
+			if err := c.syncVolumeMigration(m, &status); err != nil {
+				glog.Errorf("failed to migrate PVC %s/%s to node %s: %v", m.Namespace, m.Spec.PVCName, m.Spec.TargetNode, err)
+				status.Message = err.Error()
+			}
+		}
+		if err := c.saveVolumeMigration(m, status); err != nil {
+			glog.Errorf("failed to update volume migration %s/%s: %v", m.Namespace, m.Name, err)
+		}
+	}
+}
+
+// ownsVolumeMigration reports whether the migration is from this node
+func (c *Controller) ownsVolumeMigration(m *VolumeMigration) bool {
+	if m.Status.SourceNode != "" {
+		return m.Status.SourceNode == c.nodeName
+	}
+	obj, exists, err := c.store.GetByKey(m.Namespace + "/" + m.Spec.PVCName)
+	if err != nil || !exists {
+		return false
+	}
+	return obj.(*v1.PersistentVolumeClaim).Annotations[util.AnnProvisionerNode] == c.nodeName
+}
+
+func (c *Controller) syncVolumeMigration(m *VolumeMigration, status *VolumeMigrationStatus) error {
+	switch status.Phase {
+	case "", MigrationPending:
+		return c.startVolumeMigration(m, status)
+	case MigrationCopying:
+		return c.copyVolume(m, status)
+	case MigrationVerifying:
+		return c.verifyVolume(m, status)
+	case MigrationRebinding:
+		return c.rebindVolume(m, status)
+	}
+	return fmt.Errorf("unknown phase %s", status.Phase)
+}
+
+func failMigration(status *VolumeMigrationStatus, format string, args ...interface{}) error {
+	status.Phase = MigrationFailed
+	status.Message = fmt.Sprintf(format, args...)
+	return nil
+}
+
+func (c *Controller) startVolumeMigration(m *VolumeMigration, status *VolumeMigrationStatus) error {
+	key := m.Namespace + "/" + m.Spec.PVCName
+	status.Phase = MigrationPending
+	status.SourceNode = c.nodeName
+	if m.DeletionTimestamp != nil {
+		return failMigration(status, "migration is cancelled")
+	}
+	obj, exists, err := c.store.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return failMigration(status, "PVC %s is not found", key)
+	}
+	pvc := obj.(*v1.PersistentVolumeClaim)
+	ann := pvc.GetAnnotations()
+	target := m.Spec.TargetNode
+	switch {
+	case target == "":
+		return failMigration(status, "targetNode is not set")
+	case target == c.nodeName:
+		return failMigration(status, "PVC %s is already on node %s", key, target)
+	case util.EncryptionOptionsFromAnnotations(ann) != nil:
+		return failMigration(status, "encrypted PVC %s can't be migrated", key)
+	case c.transfer == nil:
+		return failMigration(status, "volume transfer is disabled on node %s, the transfer secret is not mounted", c.nodeName)
+	case c.Decommissioning():
+		return failMigration(status, "node %s is being decommissioned, its volumes are migrated by the decommission", c.nodeName)
+	case ann[util.AnnProvisionerHostPath] == "" || pvc.Status.Phase != v1.ClaimBound:
+		status.Message = fmt.Sprintf("waiting for PVC %s to be provisioned", key)
+		return nil
+	}
+	pv, err := c.kubeCli.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pv.Annotations[util.AnnProvisionerImported] == "true" {
+		return failMigration(status, "PV %s of PVC %s is imported, it can't be migrated", pv.Name, key)
+	}
+	pod, err := c.podUsingPVC(pvc)
+	if err != nil {
+		return err
+	}
+	if pod != "" {
+		status.Message = fmt.Sprintf("waiting for pod %s using PVC %s to stop", pod, key)
+		return nil
+	}
+	lvName, vgName := ann[util.AnnProvisionerLVName], ann[util.AnnProvisionerVGName]
+	size, err := c.lvm.LVSize(lvName, vgName)
+	if err != nil {
+		return err
+	}
+	status.PVCUID = string(pvc.UID)
+	status.VolumeName = migratedPVName(pv.Name, target)
+	status.LVName = lvName
+	status.VGName = vgName
+	if m.Spec.TargetVG != "" {
+		status.VGName = m.Spec.TargetVG
+	}
+	status.TotalBytes = size
+	status.CopiedBytes = 0
+	status.Checksum = ""
+	status.Attempts = 0
+	status.Phase = MigrationCopying
+	status.Message = ""
+	c.recordPVCEvent(pvc, v1.EventTypeNormal, "MigrationStarted", "copying blocks of LV %s/%s to node %s", vgName, lvName, target)
+	return nil
+}
+
+// copyingPVC returns the PVC whose LV is being copied, or nil if the copy is
+// given up because the migration is cancelled or the PVC is deleted
+func (c *Controller) copyingPVC(m *VolumeMigration, status *VolumeMigrationStatus) (*v1.PersistentVolumeClaim, error) {
+	key := m.Namespace + "/" + m.Spec.PVCName
+	obj, exists, err := c.store.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var reason string
+	switch {
+	case m.DeletionTimestamp != nil:
+		reason = "migration is cancelled"
+	case c.Decommissioning():
+		reason = fmt.Sprintf("node %s is being decommissioned, its volumes are migrated by the decommission", c.nodeName)
+	case !exists || string(obj.(*v1.PersistentVolumeClaim).UID) != status.PVCUID:
+		reason = fmt.Sprintf("PVC %s is deleted", key)
+	default:
+		return obj.(*v1.PersistentVolumeClaim), nil
+	}
+	client, err := c.transferClient(m.Spec.TargetNode)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.abort(c.blockVolume(m, *status, util.LVLayout{})); err != nil {
+		return nil, err
+	}
+	return nil, failMigration(status, "%s, the copy is removed", reason)
+}
+
+func (c *Controller) blockVolume(m *VolumeMigration, status VolumeMigrationStatus, layout util.LVLayout) transferVolume {
+	return transferVolume{
+		PVCNamespace: m.Namespace,
+		PVCName:      m.Spec.PVCName,
+		PVCUID:       status.PVCUID,
+		PVName:       status.VolumeName,
+		LVName:       status.LVName,
+		VGName:       status.VGName,
+		Size:         status.TotalBytes,
+		Layout:       layout,
+		Block:        true,
+	}
+}
+
+// sourceVolume prepares the LV on the target node and returns the device of
+// the source LV, the filesystem is synced first so that the device is up to
+// date
+func (c *Controller) sourceVolume(m *VolumeMigration, status VolumeMigrationStatus, pvc *v1.PersistentVolumeClaim) (*transferClient, transferVolume, string, error) {
+	ann := pvc.GetAnnotations()
+	layout, err := util.LVLayoutFromAnnotations(ann)
+	if err != nil {
+		return nil, transferVolume{}, "", err
+	}
+	v := c.blockVolume(m, status, layout)
+	client, err := c.transferClient(m.Spec.TargetNode)
+	if err != nil {
+		return nil, v, "", err
+	}
+	if _, err := client.prepare(v); err != nil {
+		return nil, v, "", err
+	}
+	if err := syncFS(ann[util.AnnProvisionerHostPath]); err != nil {
+		return nil, v, "", err
+	}
+	return client, v, getDevPath(status.LVName, ann[util.AnnProvisionerVGName]), nil
+}
+
+// copyVolume sends the chunks of the LV from where the copy is left
+func (c *Controller) copyVolume(m *VolumeMigration, status *VolumeMigrationStatus) error {
+	pvc, err := c.copyingPVC(m, status)
+	if err != nil || pvc == nil {
+		return err
+	}
+	pod, err := c.podUsingPVC(pvc)
+	if err != nil {
+		return err
+	}
+	if pod != "" {
+		status.Message = fmt.Sprintf("waiting for pod %s using PVC %s/%s to stop", pod, pvc.Namespace, pvc.Name)
+		return nil
+	}
+	client, v, devPath, err := c.sourceVolume(m, *status, pvc)
+	if err != nil {
+		return err
+	}
+	dev, err := os.Open(devPath)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	buf := make([]byte, blockChunkSize)
+	start, saved, begin := time.Now(), time.Now(), status.CopiedBytes
+	for status.CopiedBytes < status.TotalBytes {
+		select {
+		case <-c.stopCh:
+			status.Message = fmt.Sprintf("copied %d of %d bytes, interrupted by shutdown", status.CopiedBytes, status.TotalBytes)
+			return nil
+		default:
+		}
+		n := status.TotalBytes - status.CopiedBytes
+		if n > blockChunkSize {
+			n = blockChunkSize
+		}
+		if _, err := dev.ReadAt(buf[:n], status.CopiedBytes); err != nil {
+			return fmt.Errorf("failed to read %s at %d: %v", devPath, status.CopiedBytes, err)
+		}
+		if err := client.sendBlock(v, status.CopiedBytes, buf[:n]); err != nil {
+			return fmt.Errorf("failed to copy chunk at %d: %v", status.CopiedBytes, err)
+		}
+		status.CopiedBytes += n
+		if time.Since(saved) > migrationProgressInterval {
+			status.Message = fmt.Sprintf("copied %d of %d bytes", status.CopiedBytes, status.TotalBytes)
+			if err := c.saveVolumeMigration(m, *status); err != nil {
+				glog.Warningf("failed to save progress of volume migration %s/%s: %v", m.Namespace, m.Name, err)
+			}
+			saved = time.Now()
+		}
+	}
+	glog.Infof("copied %d bytes of LV %s to node %s in %v", status.TotalBytes-begin, status.LVName, m.Spec.TargetNode, time.Since(start))
+	status.Phase = MigrationVerifying
+	status.Message = fmt.Sprintf("copied %d bytes", status.TotalBytes)
+	return nil
+}
+
+// verifyVolume compares the checksums of the chunks of the source and the
+// copy, and copies the differing chunks again. Once they all match, the copy
+// is mounted and its PV is created.
+func (c *Controller) verifyVolume(m *VolumeMigration, status *VolumeMigrationStatus) error {
+	pvc, err := c.copyingPVC(m, status)
+	if err != nil || pvc == nil {
+		return err
+	}
+	client, err := c.transferClient(m.Spec.TargetNode)
+	if err != nil {
+		return err
+	}
+	// mounting the copy changes its blocks, it's not verified again
+	if status.Checksum == "" {
+		verified, err := c.verifyChunks(m, status, pvc)
+		if err != nil || !verified {
+			return err
+		}
+	} else {
+		// the source may be written by a pod started after verification,
+		// the copy may be mounted already so its blocks are copied again
+		pod, err := c.podUsingPVC(pvc)
+		if err != nil {
+			return err
+		}
+		if pod != "" {
+			if err := client.abort(c.blockVolume(m, *status, util.LVLayout{})); err != nil {
+				return err
+			}
+			// the PV of the copy may be created before the phase is saved
+			err = c.kubeCli.CoreV1().PersistentVolumes().Delete(status.VolumeName, &metav1.DeleteOptions{})
+			if err != nil && !apierr.IsNotFound(err) {
+				return err
+			}
+			restartMigration(status, fmt.Sprintf("pod %s started after verification, the copy is given up", pod))
+			return nil
+		}
+	}
+	mounted, err := client.mount(c.blockVolume(m, *status, util.LVLayout{}))
+	if err != nil {
+		// the copy isn't mounted, it's verified again
+		status.Checksum = ""
+		return err
+	}
+	pv, err := c.kubeCli.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	newPV, err := c.migratedPV(pv, pvc, mounted, m.Spec.TargetNode)
+	if err != nil {
+		return err
+	}
+	if _, err := c.kubeCli.CoreV1().PersistentVolumes().Create(newPV); err != nil && !apierr.IsAlreadyExists(err) {
+		return err
+	}
+	status.Phase = MigrationRebinding
+	status.Message = fmt.Sprintf("verified %d bytes", status.TotalBytes)
+	c.recordPVCEvent(pvc, v1.EventTypeNormal, "MigrationCopied", "verified copy of LV %s on node %s, checksum %s", status.LVName, m.Spec.TargetNode, status.Checksum)
+	return nil
+}
+
+// verifyChunks reports whether all the chunks of the copy match the source,
+// the differing chunks are copied again
+func (c *Controller) verifyChunks(m *VolumeMigration, status *VolumeMigrationStatus, pvc *v1.PersistentVolumeClaim) (bool, error) {
+	pod, err := c.podUsingPVC(pvc)
+	if err != nil {
+		return false, err
+	}
+	if pod != "" {
+		status.Message = fmt.Sprintf("waiting for pod %s using PVC %s/%s to stop", pod, pvc.Namespace, pvc.Name)
+		return false, nil
+	}
+	client, v, devPath, err := c.sourceVolume(m, *status, pvc)
+	if err != nil {
+		return false, err
+	}
+	sums, err := blockChecksums(devPath, status.TotalBytes)
+	if err != nil {
+		return false, err
+	}
+	targetSums, err := client.verify(v)
+	if err != nil {
+		return false, err
+	}
+	var differ []int64
+	for i, sum := range sums {
+		if i >= len(targetSums) || targetSums[i] != sum {
+			differ = append(differ, int64(i)*blockChunkSize)
+		}
+	}
+	if len(differ) > 0 {
+		status.Attempts++
+		if status.Attempts > maxVerifyAttempts {
+			if err := client.abort(v); err != nil {
+				return false, err
+			}
+			return false, failMigration(status, "%d chunks still differ after they are copied again %d times, the copy is removed", len(differ), maxVerifyAttempts)
+		}
+		glog.Warningf("%d chunks of LV %s differ on node %s, copy them again", len(differ), status.LVName, m.Spec.TargetNode)
+		dev, err := os.Open(devPath)
+		if err != nil {
+			return false, err
+		}
+		defer dev.Close()
+		buf := make([]byte, blockChunkSize)
+		for _, offset := range differ {
+			n := status.TotalBytes - offset
+			if n > blockChunkSize {
+				n = blockChunkSize
+			}
+			if _, err := dev.ReadAt(buf[:n], offset); err != nil {
+				return false, fmt.Errorf("failed to read %s at %d: %v", devPath, offset, err)
+			}
+			if err := client.sendBlock(v, offset, buf[:n]); err != nil {
+				return false, fmt.Errorf("failed to copy chunk at %d: %v", offset, err)
+			}
+		}
+		status.Message = fmt.Sprintf("copied %d chunks differing from the source again", len(differ))
+		return false, nil
+	}
+	// the source may be written by a pod started while it's read
+	pod, err = c.podUsingPVC(pvc)
+	if err != nil {
+		return false, err
+	}
+	if pod != "" {
+		status.Message = fmt.Sprintf("pod %s started during verification, waiting for it to stop", pod)
+		return false, nil
+	}
+	status.Checksum = checksum([]byte(strings.Join(sums, "")))
+	return true, nil
+}
+
+// rebindVolume recreates the PVC bound to the verified copy
+func (c *Controller) rebindVolume(m *VolumeMigration, status *VolumeMigrationStatus) error {
+	pv, err := c.kubeCli.CoreV1().PersistentVolumes().Get(status.VolumeName, metav1.GetOptions{})
+	if apierr.IsNotFound(err) {
+		// the copy is removed if a pod started using the PVC before it's
+		// rebound
+		restartMigration(status, "the copy is given up, migrating again")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if m.DeletionTimestamp != nil {
+		// it can only be cancelled before the PVC is deleted
+		obj, exists, err := c.store.GetByKey(m.Namespace + "/" + m.Spec.PVCName)
+		if err != nil {
+			return err
+		}
+		if pvc, ok := obj.(*v1.PersistentVolumeClaim); exists && ok && pvc.Spec.VolumeName != pv.Name && pvc.DeletionTimestamp == nil {
+			if err := c.abortMigration(pv, pvc); err != nil {
+				return err
+			}
+			return failMigration(status, "migration is cancelled, the copy is removed")
+		}
+	}
+	waiting, err := c.finishMigration(pv)
+	if err != nil {
+		return err
+	}
+	if waiting != "" {
+		status.Message = waiting
+		return nil
+	}
+	status.Phase = MigrationSucceeded
+	status.Message = fmt.Sprintf("migrated to node %s", m.Spec.TargetNode)
+	return nil
+}
+
+// restartMigration copies the volume again once the pods using the PVC stop
+func restartMigration(status *VolumeMigrationStatus, message string) {
+	status.Phase = MigrationPending
+	status.CopiedBytes = 0
+	status.Attempts = 0
+	status.Checksum = ""
+	status.Message = message
+}
+
+// syncFS flushes the filesystem mounted at the path to its device
+func syncFS(mntPath string) error {
+	dir, err := os.Open(mntPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return unix.Syncfs(int(dir.Fd()))
+}
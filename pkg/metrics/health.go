@@ -0,0 +1,22 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// RegisterHandlers serves /metrics, /healthz and /readyz on the mux, the
+// process is ready if ready returns nil
+func RegisterHandlers(mux *http.ServeMux, ready func() error) {
+	mux.Handle("/metrics", Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+}
@@ -0,0 +1,259 @@
+// Package metrics is a minimal implementation of Prometheus counters,
+// gauges and histograms exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const labelSeparator = "\xff"
+
+// DefBuckets are the default histogram buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var registry = &metricRegistry{}
+
+// scrapeLock serializes the scrapes, collectors reset and refill shared
+// gauges so a concurrent scrape could otherwise serve a half-filled vector
+var scrapeLock sync.Mutex
+
+type metricRegistry struct {
+	sync.Mutex
+	families   []*family
+	collectors []func()
+}
+
+type family struct {
+	sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newFamily(name, help, kind string, buckets []float64, labels []string) *family {
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*series{},
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	for _, existing := range registry.families {
+		if existing.name == name {
+			panic(fmt.Sprintf("metric %s registered twice", name))
+		}
+	}
+	registry.families = append(registry.families, f)
+	return f
+}
+
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects labels %v, got %v", f.name, f.labels, labelValues))
+	}
+	key := strings.Join(labelValues, labelSeparator)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if f.buckets != nil {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) delete(labelValues []string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.series, strings.Join(labelValues, labelSeparator))
+}
+
+func (f *family) reset() {
+	f.Lock()
+	defer f.Unlock()
+	f.series = map[string]*series{}
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	f *family
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: newFamily(name, help, "counter", nil, labels)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	c.f.Lock()
+	defer c.f.Unlock()
+	c.f.get(labelValues).value += v
+}
+
+// GaugeVec is a set of gauges partitioned by label values
+type GaugeVec struct {
+	f *family
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: newFamily(name, help, "gauge", nil, labels)}
+}
+
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	g.f.Lock()
+	defer g.f.Unlock()
+	g.f.get(labelValues).value = v
+}
+
+func (g *GaugeVec) Add(v float64, labelValues ...string) {
+	g.f.Lock()
+	defer g.f.Unlock()
+	g.f.get(labelValues).value += v
+}
+
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.f.delete(labelValues)
+}
+
+// Reset removes all the gauges, it's used by collectors which set all the
+// gauges of the vector on every scrape
+func (g *GaugeVec) Reset() {
+	g.f.reset()
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	f *family
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{f: newFamily(name, help, "histogram", buckets, labels)}
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.f.Lock()
+	defer h.f.Unlock()
+	s := h.f.get(labelValues)
+	for i, bound := range h.f.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// RegisterCollector registers a function called before every scrape, it's
+// used to update gauges whose values are read from the system
+func RegisterCollector(collect func()) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.collectors = append(registry.collectors, collect)
+}
+
+// Handler serves all the registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scrapeLock.Lock()
+		defer scrapeLock.Unlock()
+		registry.Lock()
+		collectors := append([]func(){}, registry.collectors...)
+		families := append([]*family{}, registry.families...)
+		registry.Unlock()
+		for _, collect := range collectors {
+			collect()
+		}
+		var buf bytes.Buffer
+		for _, f := range families {
+			f.write(&buf)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
+
+func (f *family) write(buf *bytes.Buffer) {
+	f.Lock()
+	defer f.Unlock()
+	if len(f.series) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", 0), formatValue(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", bound), s.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", math.Inf(1)), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", 0), formatValue(s.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "", 0), s.count)
+	}
+}
+
+// the text format only escapes these characters, any other byte including
+// non-ASCII UTF-8 is written as is
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func formatLabels(names, values []string, extraName string, extraValue float64) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, formatValue(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
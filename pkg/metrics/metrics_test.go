@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		names      []string
+		values     []string
+		extraName  string
+		extraValue float64
+		expect     string
+	}{
+		{expect: ""},
+		{names: []string{"vg"}, values: []string{"lvm-data"}, expect: `{vg="lvm-data"}`},
+		{names: []string{"ns", "pvc"}, values: []string{"default", "data-0"}, expect: `{ns="default",pvc="data-0"}`},
+		{names: []string{"path"}, values: []string{`C:\data`}, expect: `{path="C:\\data"}`},
+		{names: []string{"msg"}, values: []string{`say "hi"`}, expect: `{msg="say \"hi\""}`},
+		{names: []string{"msg"}, values: []string{"a\nb"}, expect: `{msg="a\nb"}`},
+		// UTF-8 and control characters other than newline are kept as is
+		{names: []string{"name"}, values: []string{"数据\tü"}, expect: "{name=\"数据\tü\"}"},
+		{names: []string{"vg"}, values: []string{"ssd"}, extraName: "le", extraValue: 0.5, expect: `{vg="ssd",le="0.5"}`},
+		{extraName: "le", extraValue: math.Inf(1), expect: `{le="+Inf"}`},
+	}
+	for _, test := range tests {
+		if got := formatLabels(test.names, test.values, test.extraName, test.extraValue); got != test.expect {
+			t.Errorf("formatLabels(%q, %q, %q, %v): expect %s, got %s", test.names, test.values, test.extraName, test.extraValue, test.expect, got)
+		}
+	}
+}
+
+func TestHelpEscaper(t *testing.T) {
+	tests := []struct {
+		help   string
+		expect string
+	}{
+		{help: "bytes of the volume", expect: "bytes of the volume"},
+		{help: `"quoted" help`, expect: `"quoted" help`},
+		{help: `a\b`, expect: `a\\b`},
+		{help: "a\nb", expect: `a\nb`},
+	}
+	for _, test := range tests {
+		if got := helpEscaper.Replace(test.help); got != test.expect {
+			t.Errorf("%q: expect %s, got %s", test.help, test.expect, got)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import "k8s.io/client-go/util/workqueue"
+
+var (
+	workqueueDepth = NewGaugeVec("workqueue_depth",
+		"Current depth of workqueue", "name")
+	workqueueAdds = NewCounterVec("workqueue_adds_total",
+		"Total number of adds handled by workqueue", "name")
+	workqueueLatency = NewHistogramVec("workqueue_queue_duration_seconds",
+		"How long an item stays in workqueue before being requested", DefBuckets, "name")
+	workqueueWorkDuration = NewHistogramVec("workqueue_work_duration_seconds",
+		"How long processing an item from workqueue takes", DefBuckets, "name")
+	workqueueRetries = NewCounterVec("workqueue_retries_total",
+		"Total number of retries handled by workqueue", "name")
+)
+
+func init() {
+	workqueue.SetProvider(workqueueProvider{})
+}
+
+type workqueueProvider struct{}
+
+func (workqueueProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return gauge{vec: workqueueDepth, name: name}
+}
+
+func (workqueueProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return counter{vec: workqueueAdds, name: name}
+}
+
+func (workqueueProvider) NewLatencyMetric(name string) workqueue.SummaryMetric {
+	return microseconds{vec: workqueueLatency, name: name}
+}
+
+func (workqueueProvider) NewWorkDurationMetric(name string) workqueue.SummaryMetric {
+	return microseconds{vec: workqueueWorkDuration, name: name}
+}
+
+func (workqueueProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return counter{vec: workqueueRetries, name: name}
+}
+
+type gauge struct {
+	vec  *GaugeVec
+	name string
+}
+
+func (g gauge) Inc() { g.vec.Add(1, g.name) }
+func (g gauge) Dec() { g.vec.Add(-1, g.name) }
+
+type counter struct {
+	vec  *CounterVec
+	name string
+}
+
+func (c counter) Inc() { c.vec.Inc(c.name) }
+
+// microseconds converts the microseconds observed by workqueue to seconds
+type microseconds struct {
+	vec  *HistogramVec
+	name string
+}
+
+func (m microseconds) Observe(v float64) { m.vec.Observe(v/1e6, m.name) }
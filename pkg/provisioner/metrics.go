@@ -0,0 +1,23 @@
+package provisioner
+
+import "github.com/tennix/k8s-lvm-manager/pkg/metrics"
+
+var (
+	provisionTotal = metrics.NewCounterVec("lvm_provisioner_provision_total",
+		"Total number of provision attempts by result", "result")
+	deleteTotal = metrics.NewCounterVec("lvm_provisioner_delete_total",
+		"Total number of delete attempts by result", "result")
+)
+
+// result returns the metric label of an attempt, waiting means the volume
+// manager has not finished its work on the node yet
+func result(err error, waiting bool) string {
+	switch {
+	case err == nil:
+		return "success"
+	case waiting:
+		return "waiting"
+	default:
+		return "error"
+	}
+}
@@ -3,28 +3,53 @@ package provisioner
 import (
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/kubernetes-incubator/external-storage/lib/controller"
 	"github.com/tennix/k8s-lvm-manager/pkg/util"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 )
 
 type Controller struct {
-	kubeCli kubernetes.Interface
+	kubeCli  kubernetes.Interface
+	recorder record.EventRecorder
+
+	// waiting are the UIDs of the PVs reported to wait for their LVs to be
+	// removed, the event is recorded once per PV
+	waitingLock sync.Mutex
+	waiting     map[types.UID]bool
 }
 
 var _ controller.Provisioner = &Controller{}
 
 func New(kubeCli kubernetes.Interface) controller.Provisioner {
 	return &Controller{
-		kubeCli: kubeCli,
+		kubeCli:  kubeCli,
+		recorder: util.NewEventRecorder(kubeCli, "lvm-volume-provisioner", ""),
+		waiting:  map[types.UID]bool{},
 	}
 }
 
+var errWaitingForLV = errors.New("waiting for lvm volume manager creating LV")
+
 func (c *Controller) Provision(opts controller.VolumeOptions) (*v1.PersistentVolume, error) {
+	pv, err := c.provision(opts)
+	provisionTotal.Inc(result(err, err == errWaitingForLV))
+	if err == nil {
+		if pod := util.PodReference(opts.PVC); pod != nil {
+			c.recorder.Eventf(pod, v1.EventTypeNormal, "VolumeProvisioned", "PV %s of PVC %s is provisioned on node %s",
+				pv.Name, opts.PVC.Name, pv.Annotations[util.AnnProvisionerNode])
+		}
+	}
+	return pv, err
+}
+
+func (c *Controller) provision(opts controller.VolumeOptions) (*v1.PersistentVolume, error) {
 	pvc := opts.PVC
 	ns := pvc.GetNamespace()
 	name := pvc.GetName()
@@ -45,7 +70,7 @@ func (c *Controller) Provision(opts controller.VolumeOptions) (*v1.PersistentVol
 	vgName := ann[util.AnnProvisionerVGName]
 	hostPath, ok := ann[util.AnnProvisionerHostPath]
 	if ok && hostPath != "" {
-		return &v1.PersistentVolume{
+		pv := &v1.PersistentVolume{
 			ObjectMeta: metav1.ObjectMeta{
 				Name: opts.PVName,
 				Annotations: map[string]string{
@@ -68,12 +93,37 @@ func (c *Controller) Provision(opts controller.VolumeOptions) (*v1.PersistentVol
 					},
 				},
 			},
-		}, nil
+		}
+		if encryption := util.EncryptionOptionsFromAnnotations(ann); encryption != nil {
+			encryption.Annotate(pv.Annotations)
+		}
+		if erase, err := util.EraseOptionsFromAnnotations(ann); err == nil {
+			erase.Annotate(pv.Annotations)
+		}
+		return pv, nil
 	}
-	return nil, errors.New("waiting for lvm volume manager creating LV")
+	return nil, errWaitingForLV
 }
 
 func (c *Controller) Delete(pv *v1.PersistentVolume) error {
+	err := c.delete(pv)
+	_, waiting := err.(*controller.IgnoredError)
+	deleteTotal.Inc(result(err, waiting))
+	c.waitingLock.Lock()
+	defer c.waitingLock.Unlock()
+	switch {
+	case !waiting:
+		delete(c.waiting, pv.UID)
+	case c.waiting[pv.UID]:
+		glog.V(2).Infof("PV %s: %v", pv.Name, err)
+	default:
+		c.waiting[pv.UID] = true
+		c.recorder.Eventf(pv, v1.EventTypeNormal, "WaitingForLVRemoval", "%v", err)
+	}
+	return err
+}
+
+func (c *Controller) delete(pv *v1.PersistentVolume) error {
 	pvName := pv.GetName()
 	ann := pv.GetAnnotations()
 	lvName := ann[util.AnnProvisionerLVName]
@@ -0,0 +1,22 @@
+package scheduler
+
+import "github.com/tennix/k8s-lvm-manager/pkg/metrics"
+
+// reasons of rejecting nodes
+const (
+	reasonInvalidVGs        = "invalid_vgs"
+	reasonNoMatchingVG      = "no_matching_vg"
+	reasonInsufficientSpace = "insufficient_space"
+	reasonNodeMismatch      = "node_mismatch"
+	reasonWaitingForVolume  = "waiting_for_volume"
+	reasonDecommissioning   = "decommissioning"
+)
+
+var (
+	requestTotal = metrics.NewCounterVec("lvm_scheduler_requests_total",
+		"Total number of extender requests by verb and result", "verb", "result")
+	requestDuration = metrics.NewHistogramVec("lvm_scheduler_request_duration_seconds",
+		"Latency of extender requests", metrics.DefBuckets, "verb")
+	rejectionTotal = metrics.NewCounterVec("lvm_scheduler_rejections_total",
+		"Total number of nodes or pods rejected by reason", "reason")
+)
@@ -4,15 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	restful "github.com/emicklei/go-restful"
 	"github.com/golang/glog"
+	"github.com/tennix/k8s-lvm-manager/pkg/metrics"
 	"github.com/tennix/k8s-lvm-manager/pkg/util"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	schedulerapiv1 "k8s.io/kubernetes/pkg/scheduler/api/v1"
 )
 
@@ -27,18 +32,22 @@ type Scheduler interface {
 }
 
 type lvmScheduler struct {
-	kubeCli      kubernetes.Interface
-	domainName   string
-	storageClass string
+	kubeCli        kubernetes.Interface
+	recorder       record.EventRecorder
+	domainName     string
+	storageClass   string
+	lvNameTemplate string
 }
 
 var _ Scheduler = &lvmScheduler{}
 
-func NewLVMScheduler(kubeCli kubernetes.Interface, domainName, storageClass string) Scheduler {
+func NewLVMScheduler(kubeCli kubernetes.Interface, domainName, storageClass, lvNameTemplate string) Scheduler {
 	return &lvmScheduler{
-		kubeCli:      kubeCli,
-		domainName:   domainName,
-		storageClass: storageClass,
+		kubeCli:        kubeCli,
+		recorder:       util.NewEventRecorder(kubeCli, "lvm-scheduler", ""),
+		domainName:     domainName,
+		storageClass:   storageClass,
+		lvNameTemplate: lvNameTemplate,
 	}
 }
 
@@ -78,52 +87,234 @@ func (ls *lvmScheduler) Filter(args *schedulerapiv1.ExtenderArgs) (*schedulerapi
 	annNode := pvc.Annotations[util.AnnProvisionerNode]
 	annHostPath := pvc.Annotations[util.AnnProvisionerHostPath]
 	if annNode != "" && annHostPath != "" {
-		for _, node := range args.Nodes.Items {
-			if annNode == node.GetName() {
-				glog.Infof("pod %s/%s will be scheduled on node %s", ns, podName, annNode)
-				return &schedulerapiv1.ExtenderFilterResult{
-					Nodes: &apiv1.NodeList{Items: []apiv1.Node{node}},
-				}, nil
-			}
+		glog.Infof("pod %s/%s will be scheduled on node %s", ns, podName, annNode)
+		return filterByNodeName(args.Nodes.Items, annNode, fmt.Sprintf("invalid nodeName: %s and hostPath: %s", annNode, annHostPath)), nil
+	}
+	if pvc.Spec.VolumeName != "" {
+		// statically provisioned PV, e.g. an imported LV
+		pv, err := ls.kubeCli.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			glog.Errorf("can't get pv %s: %v", pvc.Spec.VolumeName, err)
+			return nil, err
 		}
-		return &schedulerapiv1.ExtenderFilterResult{
-			Error: fmt.Sprintf("invalid nodeName: %s and hostPath: %s", annNode, annHostPath),
-		}, nil
+		pvNode := pv.Annotations[util.AnnProvisionerNode]
+		glog.Infof("pod %s/%s will be scheduled on node %s of pv %s", ns, podName, pvNode, pv.Name)
+		return filterByNodeName(args.Nodes.Items, pvNode, fmt.Sprintf("invalid nodeName: %s of pv %s", pvNode, pv.Name)), nil
+	}
+
+	sc, err := ls.kubeCli.StorageV1().StorageClasses().Get(ls.storageClass, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("can't get storage class %s: %v", ls.storageClass, err)
+		return nil, err
+	}
+	vgSelector := sc.Parameters[util.ParamVGSelector]
+	layout, err := util.ParseLVLayout(sc.Parameters)
+	if err != nil {
+		glog.Errorf("invalid LV layout of storage class %s: %v", ls.storageClass, err)
+		return nil, err
+	}
+	cache, err := util.ParseCacheOptions(sc.Parameters)
+	if err != nil {
+		glog.Errorf("invalid cache options of storage class %s: %v", ls.storageClass, err)
+		return nil, err
+	}
+	erase, err := util.ParseEraseOptions(sc.Parameters)
+	if err != nil {
+		glog.Errorf("invalid erase options of storage class %s: %v", ls.storageClass, err)
+		return nil, err
+	}
+	autoGrow, err := util.ParseAutoGrowOptions(sc.Parameters)
+	if err != nil {
+		glog.Errorf("invalid auto-grow options of storage class %s: %v", ls.storageClass, err)
+		return nil, err
+	}
+	ioLimits, err := util.ParseIOLimits(sc.Parameters)
+	if err != nil {
+		glog.Errorf("invalid IO limits of storage class %s: %v", ls.storageClass, err)
+		return nil, err
+	}
+	ownership, err := util.ParseOwnershipOptions(sc.Parameters)
+	if err != nil {
+		glog.Errorf("invalid ownership options of storage class %s: %v", ls.storageClass, err)
+		return nil, err
+	}
+	// hostPath volumes are not chowned to fsGroup by kubelet
+	if podSC := pod.Spec.SecurityContext; podSC != nil && podSC.FSGroup != nil {
+		ownership.FSGroup = int(*podSC.FSGroup)
 	}
 
 	var vgName string
 	var size string
-	// NOTE: only support one PVC
-	for _, container := range pod.Spec.Containers {
-		for resourceName, quantity := range container.Resources.Requests {
-			rn := resourceName.String()
-			if strings.HasPrefix(rn, ls.domainName) {
-				vgName = strings.Split(rn, "/")[1]
-				size = quantity.String()
-				break
+	var nodeName string
+	if vgSelector != "" {
+		nodeName = pvc.Annotations[util.AnnProvisionerNode]
+		vgName = pvc.Annotations[util.AnnProvisionerVGName]
+		quantity := pvc.Spec.Resources.Requests[apiv1.ResourceStorage]
+		if nodeName == "" || vgName == "" {
+			var failedNodes schedulerapiv1.FailedNodesMap
+			match := func(vg util.VGInfo) bool {
+				return util.MatchVGSelector(vgSelector, vg.Tags) && cache.Fits(vg, quantity.Value())
+			}
+			nodeName, vgName, failedNodes = selectVG(args.Nodes.Items, match, quantity.Value(), layout)
+			if nodeName == "" {
+				glog.Infof("no node has VG matching %s for pod %s/%s", vgSelector, ns, podName)
+				ls.recorder.Eventf(pod, apiv1.EventTypeWarning, "NoLVMCapacity",
+					"no node has a VG matching %s with room for PVC %s: %s", vgSelector, pvcName, failedNodesMessage(failedNodes))
+				return &schedulerapiv1.ExtenderFilterResult{FailedNodes: failedNodes}, nil
 			}
 		}
+		size = fmt.Sprintf("%db", quantity.Value())
+	} else {
+		// NOTE: only support one PVC
+		for _, container := range pod.Spec.Containers {
+			for resourceName, quantity := range container.Resources.Requests {
+				rn := resourceName.String()
+				if strings.HasPrefix(rn, ls.domainName) {
+					vgName = strings.Split(rn, "/")[1]
+					size = quantity.String()
+					break
+				}
+			}
+		}
+		nodeName = pvc.Annotations[util.AnnProvisionerNode]
+		if nodeName == "" && (layout.Type != util.LVTypeLinear || cache != nil) {
+			quantity, err := resource.ParseQuantity(size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size %s of VG %s: %v", size, vgName, err)
+			}
+			var failedNodes schedulerapiv1.FailedNodesMap
+			match := func(vg util.VGInfo) bool { return vg.Name == vgName && cache.Fits(vg, quantity.Value()) }
+			nodeName, _, failedNodes = selectVG(args.Nodes.Items, match, quantity.Value(), layout)
+			if nodeName == "" {
+				glog.Infof("no node has %s VG %s for pod %s/%s", layout.Type, vgName, ns, podName)
+				ls.recorder.Eventf(pod, apiv1.EventTypeWarning, "NoLVMCapacity",
+					"no node has %s VG %s with room for PVC %s: %s", layout.Type, vgName, pvcName, failedNodesMessage(failedNodes))
+				return &schedulerapiv1.ExtenderFilterResult{FailedNodes: failedNodes}, nil
+			}
+		}
+		if nodeName == "" {
+			// simply select the first node not being decommissioned
+			for i := range args.Nodes.Items {
+				if !util.NodeDecommissioning(&args.Nodes.Items[i]) {
+					nodeName = args.Nodes.Items[i].GetName()
+					break
+				}
+			}
+		}
+		if nodeName == "" {
+			glog.Infof("all nodes are being decommissioned for pod %s/%s", ns, podName)
+			rejectionTotal.Inc(reasonDecommissioning)
+			return &schedulerapiv1.ExtenderFilterResult{Error: "all nodes are being decommissioned"}, nil
+		}
 	}
 
-	nodeName := pvc.Annotations[util.AnnProvisionerNode]
-	if nodeName == "" {
-		nodeName = args.Nodes.Items[0].GetName() // simply select the first node
+	lvName := pvc.Annotations[util.AnnProvisionerLVName]
+	if lvName == "" {
+		tmpl := sc.Parameters[util.ParamLVNameTemplate]
+		if tmpl == "" {
+			tmpl = ls.lvNameTemplate
+		}
+		lvName, err = util.LVName(tmpl, util.LVNameParams{Namespace: ns, Name: pvcName, UID: string(pvc.UID)})
+		if err != nil {
+			glog.Errorf("can't name LV of pvc %s/%s: %v", ns, pvcName, err)
+			return nil, err
+		}
+	}
+	encryption, err := util.ParseEncryptionOptions(sc.Parameters, ns, lvName)
+	if err != nil {
+		glog.Errorf("invalid encryption options of storage class %s: %v", ls.storageClass, err)
+		return nil, err
 	}
-	lvName := ns + "-" + pvcName
 	pvc.Annotations[util.AnnProvisionerLVName] = lvName
 	pvc.Annotations[util.AnnProvisionerVGName] = vgName
 	pvc.Annotations[util.AnnProvisionerNode] = nodeName
 	pvc.Annotations[util.AnnProvisionerPodName] = podName
 	pvc.Annotations[util.AnnProvisionerHostPath] = ""
 	pvc.Annotations[util.AnnProvisionerLVSize] = size
+	pvc.Annotations[util.AnnProvisionerVGSelector] = vgSelector
+	layout.Annotate(pvc.Annotations)
+	cache.Annotate(pvc.Annotations)
+	encryption.Annotate(pvc.Annotations)
+	erase.Annotate(pvc.Annotations)
+	// auto-grow options set on the PVC override the storage class
+	if pvc.Annotations[util.AnnProvisionerAutoGrowThreshold] == "" {
+		autoGrow.Annotate(pvc.Annotations)
+	}
+	// so do IO limits
+	if !util.HasIOLimitAnnotations(pvc.Annotations) {
+		ioLimits.Annotate(pvc.Annotations)
+	}
+	ownership.Annotate(pvc.Annotations)
 	_, err = ls.kubeCli.CoreV1().PersistentVolumeClaims(ns).Update(pvc)
 	if err != nil {
 		glog.Errorf("failed to update pvc %s annotation: %v", pvc.Name, err)
 		return nil, err
 	}
+	ls.recorder.Eventf(pod, apiv1.EventTypeNormal, "LVMNodeSelected", "selected node %s VG %s for PVC %s", nodeName, vgName, pvcName)
+	ls.recorder.Eventf(pvc, apiv1.EventTypeNormal, "LVMNodeSelected", "selected node %s VG %s for pod %s", nodeName, vgName, podName)
+	rejectionTotal.Inc(reasonWaitingForVolume)
 	return &schedulerapiv1.ExtenderFilterResult{Error: "waiting for pvc bound with pv"}, nil
 }
 
+// failedNodesMessage summarizes why nodes are rejected in an event message
+func failedNodesMessage(failedNodes schedulerapiv1.FailedNodesMap) string {
+	var reasons []string
+	for node, reason := range failedNodes {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", node, reason))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; ")
+}
+
+// filterByNodeName returns the filter result with only the named node
+func filterByNodeName(nodes []apiv1.Node, nodeName, errMsg string) *schedulerapiv1.ExtenderFilterResult {
+	for _, node := range nodes {
+		if node.GetName() == nodeName {
+			return &schedulerapiv1.ExtenderFilterResult{
+				Nodes: &apiv1.NodeList{Items: []apiv1.Node{node}},
+			}
+		}
+	}
+	rejectionTotal.Inc(reasonNodeMismatch)
+	return &schedulerapiv1.ExtenderFilterResult{Error: errMsg}
+}
+
+// selectVG returns the first node which has a VG matching the predicate
+// with enough free space laid out for the LV
+func selectVG(nodes []apiv1.Node, match func(util.VGInfo) bool, size int64, layout util.LVLayout) (string, string, schedulerapiv1.FailedNodesMap) {
+	failedNodes := schedulerapiv1.FailedNodesMap{}
+	for i := range nodes {
+		node := &nodes[i]
+		if util.NodeDecommissioning(node) {
+			failedNodes[node.GetName()] = "node is being decommissioned"
+			rejectionTotal.Inc(reasonDecommissioning)
+			continue
+		}
+		vgs, err := util.NodeVGs(node)
+		if err != nil {
+			glog.Errorf("invalid VGs of node %s: %v", node.GetName(), err)
+			failedNodes[node.GetName()] = "invalid VGs annotation"
+			rejectionTotal.Inc(reasonInvalidVGs)
+			continue
+		}
+		reason, metricReason := "no matching VG", reasonNoMatchingVG
+		for _, vg := range vgs {
+			if !match(vg) {
+				continue
+			}
+			if !layout.Fits(vg, size) {
+				reason = fmt.Sprintf("VG %s doesn't have enough free space for %s LV", vg.Name, layout.Type)
+				metricReason = reasonInsufficientSpace
+				continue
+			}
+			return node.GetName(), vg.Name, nil
+		}
+		failedNodes[node.GetName()] = reason
+		rejectionTotal.Inc(metricReason)
+	}
+	return "", "", failedNodes
+}
+
 func (ls *lvmScheduler) Priority(args *schedulerapiv1.ExtenderArgs) (schedulerapiv1.HostPriorityList, error) {
 	return schedulerapiv1.HostPriorityList{}, nil
 }
@@ -133,9 +324,13 @@ type server struct {
 	lock      sync.Mutex
 }
 
-func StartServer(kubeCli kubernetes.Interface, port int, domainName, storageClass string) {
-	s := NewLVMScheduler(kubeCli, domainName, storageClass)
+func StartServer(kubeCli kubernetes.Interface, port int, domainName, storageClass, lvNameTemplate string) {
+	s := NewLVMScheduler(kubeCli, domainName, storageClass, lvNameTemplate)
 	svr := &server{scheduler: s}
+	metrics.RegisterHandlers(http.DefaultServeMux, func() error {
+		_, err := kubeCli.Discovery().ServerVersion()
+		return err
+	})
 
 	ws := new(restful.WebService)
 	ws.
@@ -169,7 +364,9 @@ func (svr *server) filterNode(req *restful.Request, resp *restful.Response) {
 		return
 	}
 
+	start := time.Now()
 	filterResult, err := svr.scheduler.Filter(args)
+	observeRequest("filter", start, err)
 	if err != nil {
 		errorResponse(resp, restful.NewError(http.StatusInternalServerError,
 			fmt.Sprintf("unable to filter nodes: %v", err)))
@@ -188,7 +385,9 @@ func (svr *server) prioritizeNode(req *restful.Request, resp *restful.Response)
 		return
 	}
 
+	start := time.Now()
 	priorityResult, err := svr.scheduler.Priority(args)
+	observeRequest("prioritize", start, err)
 	if err != nil {
 		errorResponse(resp, restful.NewError(http.StatusInternalServerError,
 			fmt.Sprintf("unable to priority nodes: %v", err)))
@@ -200,6 +399,15 @@ func (svr *server) prioritizeNode(req *restful.Request, resp *restful.Response)
 	}
 }
 
+func observeRequest(verb string, start time.Time, err error) {
+	requestDuration.Observe(time.Since(start).Seconds(), verb)
+	if err != nil {
+		requestTotal.Inc(verb, "error")
+	} else {
+		requestTotal.Inc(verb, "success")
+	}
+}
+
 func errorResponse(resp *restful.Response, err restful.ServiceError) {
 	glog.Error(err.Message)
 	if err := resp.WriteServiceError(err.Code, err); err != nil {
@@ -0,0 +1,111 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// AutoGrowOptions describes when and how much a LV and its filesystem are
+// extended, the LV grows by Step bytes or StepPercent of its size once the
+// used space reaches Threshold percent, but never beyond MaxSize
+type AutoGrowOptions struct {
+	Threshold   float64
+	Step        int64
+	StepPercent float64
+	MaxSize     int64
+}
+
+// ParseAutoGrowOptions parses autoGrowThreshold, autoGrowStep and
+// autoGrowMaxSize parameters, it returns nil if autoGrowThreshold is not set
+func ParseAutoGrowOptions(params map[string]string) (*AutoGrowOptions, error) {
+	s := params[ParamAutoGrowThreshold]
+	if s == "" {
+		return nil, nil
+	}
+	opts := &AutoGrowOptions{}
+	threshold, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil || threshold <= 0 || threshold >= 100 {
+		return nil, fmt.Errorf("invalid autoGrowThreshold %s, must be a percentage in (0, 100)", s)
+	}
+	opts.Threshold = threshold
+
+	step := params[ParamAutoGrowStep]
+	if step == "" {
+		return nil, fmt.Errorf("autoGrowStep is required by autoGrowThreshold")
+	}
+	if strings.HasSuffix(step, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(step, "%"), 64)
+		if err != nil || percent <= 0 {
+			return nil, fmt.Errorf("invalid autoGrowStep %s", step)
+		}
+		opts.StepPercent = percent
+	} else {
+		q, err := resource.ParseQuantity(step)
+		if err != nil || q.Value() <= 0 {
+			return nil, fmt.Errorf("invalid autoGrowStep %s", step)
+		}
+		opts.Step = q.Value()
+	}
+
+	if s := params[ParamAutoGrowMaxSize]; s != "" {
+		q, err := resource.ParseQuantity(s)
+		if err != nil || q.Value() <= 0 {
+			return nil, fmt.Errorf("invalid autoGrowMaxSize %s", s)
+		}
+		opts.MaxSize = q.Value()
+	}
+	return opts, nil
+}
+
+// AutoGrowOptionsFromAnnotations parses the options recorded by Annotate or
+// set by users on the PVC
+func AutoGrowOptionsFromAnnotations(ann map[string]string) (*AutoGrowOptions, error) {
+	return ParseAutoGrowOptions(map[string]string{
+		ParamAutoGrowThreshold: ann[AnnProvisionerAutoGrowThreshold],
+		ParamAutoGrowStep:      ann[AnnProvisionerAutoGrowStep],
+		ParamAutoGrowMaxSize:   ann[AnnProvisionerAutoGrowMaxSize],
+	})
+}
+
+// Annotate records the auto-grow options in the annotations of a PVC, nil
+// options leave the annotations untouched so that users can opt in per PVC
+func (o *AutoGrowOptions) Annotate(ann map[string]string) {
+	if o == nil {
+		return
+	}
+	ann[AnnProvisionerAutoGrowThreshold] = strconv.FormatFloat(o.Threshold, 'f', -1, 64) + "%"
+	if o.StepPercent > 0 {
+		ann[AnnProvisionerAutoGrowStep] = strconv.FormatFloat(o.StepPercent, 'f', -1, 64) + "%"
+	} else {
+		ann[AnnProvisionerAutoGrowStep] = strconv.FormatInt(o.Step, 10)
+	}
+	if o.MaxSize > 0 {
+		ann[AnnProvisionerAutoGrowMaxSize] = strconv.FormatInt(o.MaxSize, 10)
+	} else {
+		ann[AnnProvisionerAutoGrowMaxSize] = ""
+	}
+}
+
+// ShouldGrow reports whether the used percentage reaches the threshold
+func (o *AutoGrowOptions) ShouldGrow(used, capacity int64) bool {
+	return capacity > 0 && float64(used)*100 >= o.Threshold*float64(capacity)
+}
+
+// NextSize returns the size a LV of the size grows to, it equals to size if
+// MaxSize is reached
+func (o *AutoGrowOptions) NextSize(size int64) int64 {
+	next := size + o.Step
+	if o.StepPercent > 0 {
+		next = size + int64(float64(size)*o.StepPercent/100)
+	}
+	if o.MaxSize > 0 && next > o.MaxSize {
+		next = o.MaxSize
+	}
+	if next < size {
+		return size
+	}
+	return next
+}
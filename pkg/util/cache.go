@@ -0,0 +1,94 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	CacheModeWritethrough = "writethrough"
+	CacheModeWriteback    = "writeback"
+
+	defaultCacheRatio = 0.1
+)
+
+// CacheOptions describes the dm-cache attached to a LV, the origin LV is
+// allocated on the PVs without PVTag and the cache pool on the PVs with it
+type CacheOptions struct {
+	PVTag string
+	Mode  string
+	Ratio float64
+}
+
+// ParseCacheOptions parses cachePVTag, cacheMode and cacheRatio parameters,
+// it returns nil if cachePVTag is not set
+func ParseCacheOptions(params map[string]string) (*CacheOptions, error) {
+	if params[ParamCachePVTag] == "" {
+		return nil, nil
+	}
+	opts := &CacheOptions{
+		PVTag: params[ParamCachePVTag],
+		Mode:  params[ParamCacheMode],
+		Ratio: defaultCacheRatio,
+	}
+	switch opts.Mode {
+	case "":
+		opts.Mode = CacheModeWritethrough
+	case CacheModeWritethrough, CacheModeWriteback:
+	default:
+		return nil, fmt.Errorf("unsupported cacheMode %s", opts.Mode)
+	}
+	if s := params[ParamCacheRatio]; s != "" {
+		ratio, err := strconv.ParseFloat(s, 64)
+		if err != nil || ratio <= 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid cacheRatio %s, must be in (0, 1]", s)
+		}
+		opts.Ratio = ratio
+	}
+	return opts, nil
+}
+
+// CacheOptionsFromAnnotations parses the options recorded by Annotate
+func CacheOptionsFromAnnotations(ann map[string]string) (*CacheOptions, error) {
+	return ParseCacheOptions(map[string]string{
+		ParamCachePVTag: ann[AnnProvisionerCachePVTag],
+		ParamCacheMode:  ann[AnnProvisionerCacheMode],
+		ParamCacheRatio: ann[AnnProvisionerCacheRatio],
+	})
+}
+
+// Annotate records the cache options in the annotations of a PVC, nil
+// options clear them
+func (o *CacheOptions) Annotate(ann map[string]string) {
+	if o == nil {
+		ann[AnnProvisionerCachePVTag] = ""
+		ann[AnnProvisionerCacheMode] = ""
+		ann[AnnProvisionerCacheRatio] = ""
+		return
+	}
+	ann[AnnProvisionerCachePVTag] = o.PVTag
+	ann[AnnProvisionerCacheMode] = o.Mode
+	ann[AnnProvisionerCacheRatio] = strconv.FormatFloat(o.Ratio, 'f', -1, 64)
+}
+
+// CacheSize returns the size of the cache pool for a LV of the size
+func (o *CacheOptions) CacheSize(size int64) int64 {
+	return int64(float64(size) * o.Ratio)
+}
+
+// Fits reports whether the VG has enough free space on the slow PVs for the
+// origin LV and on the fast PVs for the cache pool
+func (o *CacheOptions) Fits(vg VGInfo, size int64) bool {
+	if o == nil {
+		return true
+	}
+	var slowFree, fastFree int64
+	for _, pv := range vg.PVs {
+		if HasTag(pv.Tags, o.PVTag) {
+			fastFree += pv.Free
+		} else {
+			slowFree += pv.Free
+		}
+	}
+	return slowFree >= size && fastFree >= o.CacheSize(size)
+}
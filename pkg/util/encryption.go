@@ -0,0 +1,70 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EncryptionKeySecretKey is the key of LUKS passphrase in the secret data
+const EncryptionKeySecretKey = "key"
+
+// EncryptionOptions describes where the LUKS key of an encrypted LV is kept,
+// the key is generated by the volume manager if the secret is Generated
+type EncryptionOptions struct {
+	SecretNamespace string
+	SecretName      string
+	Generated       bool
+}
+
+// ParseEncryptionOptions parses encrypted and encryptionSecret parameters,
+// it returns nil if the volume is not encrypted. Without encryptionSecret a
+// key is generated per PVC and stored in secret <lvName>-luks-key.
+func ParseEncryptionOptions(params map[string]string, ns, lvName string) (*EncryptionOptions, error) {
+	switch params[ParamEncrypted] {
+	case "", "false":
+		return nil, nil
+	case "true":
+	default:
+		return nil, fmt.Errorf("invalid encrypted %s, must be true or false", params[ParamEncrypted])
+	}
+	ref := params[ParamEncryptionSecret]
+	if ref == "" {
+		return &EncryptionOptions{SecretNamespace: ns, SecretName: lvName + "-luks-key", Generated: true}, nil
+	}
+	opts := &EncryptionOptions{SecretNamespace: ns, SecretName: ref}
+	if parts := strings.SplitN(ref, "/", 2); len(parts) == 2 {
+		opts.SecretNamespace, opts.SecretName = parts[0], parts[1]
+	}
+	if opts.SecretNamespace == "" || opts.SecretName == "" {
+		return nil, fmt.Errorf("invalid encryptionSecret %s, must be <namespace>/<name> or <name>", ref)
+	}
+	return opts, nil
+}
+
+// EncryptionOptionsFromAnnotations parses the options recorded by Annotate
+func EncryptionOptionsFromAnnotations(ann map[string]string) *EncryptionOptions {
+	if ann[AnnProvisionerEncrypted] != "true" {
+		return nil
+	}
+	return &EncryptionOptions{
+		SecretNamespace: ann[AnnProvisionerEncryptionSecretNamespace],
+		SecretName:      ann[AnnProvisionerEncryptionSecretName],
+		Generated:       ann[AnnProvisionerEncryptionKeyGenerated] == "true",
+	}
+}
+
+// Annotate records the encryption options in annotations of a PVC or PV,
+// nil options clear them
+func (o *EncryptionOptions) Annotate(ann map[string]string) {
+	if o == nil {
+		ann[AnnProvisionerEncrypted] = ""
+		ann[AnnProvisionerEncryptionSecretNamespace] = ""
+		ann[AnnProvisionerEncryptionSecretName] = ""
+		ann[AnnProvisionerEncryptionKeyGenerated] = ""
+		return
+	}
+	ann[AnnProvisionerEncrypted] = "true"
+	ann[AnnProvisionerEncryptionSecretNamespace] = o.SecretNamespace
+	ann[AnnProvisionerEncryptionSecretName] = o.SecretName
+	ann[AnnProvisionerEncryptionKeyGenerated] = fmt.Sprintf("%t", o.Generated)
+}
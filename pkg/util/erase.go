@@ -0,0 +1,64 @@
+package util
+
+import "fmt"
+
+const (
+	ErasePolicyNone       = "none"
+	ErasePolicyDiscard    = "discard"
+	ErasePolicyZeroHeader = "zero-first-mib"
+	ErasePolicyOverwrite  = "overwrite"
+
+	EraseOnDelete = "delete"
+	EraseOnCreate = "create"
+)
+
+// EraseOptions describes how the blocks of a LV are erased and whether it
+// happens before the LV is removed or before it's first used
+type EraseOptions struct {
+	Policy string
+	On     string
+}
+
+// ParseEraseOptions parses erasePolicy and eraseOn parameters
+func ParseEraseOptions(params map[string]string) (EraseOptions, error) {
+	opts := EraseOptions{Policy: params[ParamErasePolicy], On: params[ParamEraseOn]}
+	switch opts.Policy {
+	case "":
+		opts.Policy = ErasePolicyNone
+	case ErasePolicyNone, ErasePolicyDiscard, ErasePolicyZeroHeader, ErasePolicyOverwrite:
+	default:
+		return opts, fmt.Errorf("unsupported erasePolicy %s", opts.Policy)
+	}
+	switch opts.On {
+	case "":
+		opts.On = EraseOnDelete
+	case EraseOnDelete, EraseOnCreate:
+	default:
+		return opts, fmt.Errorf("invalid eraseOn %s, must be %s or %s", opts.On, EraseOnDelete, EraseOnCreate)
+	}
+	return opts, nil
+}
+
+// EraseOptionsFromAnnotations parses the options recorded by Annotate
+func EraseOptionsFromAnnotations(ann map[string]string) (EraseOptions, error) {
+	return ParseEraseOptions(map[string]string{
+		ParamErasePolicy: ann[AnnProvisionerErasePolicy],
+		ParamEraseOn:     ann[AnnProvisionerEraseOn],
+	})
+}
+
+// Annotate records the erase options in annotations of a PVC or PV
+func (o EraseOptions) Annotate(ann map[string]string) {
+	ann[AnnProvisionerErasePolicy] = o.Policy
+	ann[AnnProvisionerEraseOn] = o.On
+}
+
+// EraseOnDelete reports whether the LV must be erased before it's removed
+func (o EraseOptions) EraseOnDelete() bool {
+	return o.Policy != ErasePolicyNone && o.On == EraseOnDelete
+}
+
+// EraseOnCreate reports whether the LV must be erased before it's first used
+func (o EraseOptions) EraseOnCreate() bool {
+	return o.Policy != ErasePolicyNone && o.On == EraseOnCreate
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// NewEventRecorder returns a recorder which sends events of the component
+// to the API server and logs them
+func NewEventRecorder(cli kubernetes.Interface, component, host string) record.EventRecorder {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(glog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cli.CoreV1().Events("")})
+	return eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component, Host: host})
+}
+
+// PodReference returns the reference of the pod recorded in the PVC
+// annotation, or nil if there is no such pod
+func PodReference(pvc *v1.PersistentVolumeClaim) *v1.ObjectReference {
+	podName := pvc.GetAnnotations()[AnnProvisionerPodName]
+	if podName == "" {
+		return nil
+	}
+	return &v1.ObjectReference{Kind: "Pod", APIVersion: "v1", Namespace: pvc.GetNamespace(), Name: podName}
+}
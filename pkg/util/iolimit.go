@@ -0,0 +1,111 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// IOLimits are the bytes per second and IOPS limits of a LV applied in the
+// cgroup v2 io.max of its consuming pods, zero means unlimited
+type IOLimits struct {
+	ReadBPS   int64
+	WriteBPS  int64
+	ReadIOPS  int64
+	WriteIOPS int64
+}
+
+// ParseIOLimits parses readBPS, writeBPS, readIOPS and writeIOPS parameters,
+// it returns nil if none of them is set
+func ParseIOLimits(params map[string]string) (*IOLimits, error) {
+	limits := &IOLimits{}
+	fields := []struct {
+		param string
+		value *int64
+	}{
+		{ParamReadBPS, &limits.ReadBPS},
+		{ParamWriteBPS, &limits.WriteBPS},
+		{ParamReadIOPS, &limits.ReadIOPS},
+		{ParamWriteIOPS, &limits.WriteIOPS},
+	}
+	set := false
+	for _, f := range fields {
+		s := params[f.param]
+		if s == "" {
+			continue
+		}
+		q, err := resource.ParseQuantity(s)
+		if err != nil || q.Value() <= 0 {
+			return nil, fmt.Errorf("invalid %s %s, must be a positive quantity", f.param, s)
+		}
+		*f.value = q.Value()
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	return limits, nil
+}
+
+// IOLimitsFromAnnotations parses the limits recorded by Annotate or set by
+// users on the PVC
+func IOLimitsFromAnnotations(ann map[string]string) (*IOLimits, error) {
+	return ParseIOLimits(map[string]string{
+		ParamReadBPS:   ann[AnnProvisionerReadBPS],
+		ParamWriteBPS:  ann[AnnProvisionerWriteBPS],
+		ParamReadIOPS:  ann[AnnProvisionerReadIOPS],
+		ParamWriteIOPS: ann[AnnProvisionerWriteIOPS],
+	})
+}
+
+// HasIOLimitAnnotations reports whether any IO limit is set on the PVC
+func HasIOLimitAnnotations(ann map[string]string) bool {
+	return ann[AnnProvisionerReadBPS] != "" || ann[AnnProvisionerWriteBPS] != "" ||
+		ann[AnnProvisionerReadIOPS] != "" || ann[AnnProvisionerWriteIOPS] != ""
+}
+
+// Annotate records the IO limits in the annotations of a PVC, nil limits
+// leave the annotations untouched so that users can set them per PVC
+func (l *IOLimits) Annotate(ann map[string]string) {
+	if l == nil {
+		return
+	}
+	for key, value := range map[string]int64{
+		AnnProvisionerReadBPS:   l.ReadBPS,
+		AnnProvisionerWriteBPS:  l.WriteBPS,
+		AnnProvisionerReadIOPS:  l.ReadIOPS,
+		AnnProvisionerWriteIOPS: l.WriteIOPS,
+	} {
+		if value > 0 {
+			ann[key] = strconv.FormatInt(value, 10)
+		}
+	}
+}
+
+// IOMax returns the io.max line of the limits for the device
+func (l *IOLimits) IOMax(major, minor uint32) string {
+	return fmt.Sprintf("%d:%d %s", major, minor, l)
+}
+
+// String formats the limits as io.max does, limits not set are max
+func (l *IOLimits) String() string {
+	var limits []string
+	for _, f := range []struct {
+		key   string
+		value int64
+	}{
+		{"rbps", l.ReadBPS},
+		{"wbps", l.WriteBPS},
+		{"riops", l.ReadIOPS},
+		{"wiops", l.WriteIOPS},
+	} {
+		value := "max"
+		if f.value > 0 {
+			value = strconv.FormatInt(f.value, 10)
+		}
+		limits = append(limits, f.key+"="+value)
+	}
+	return strings.Join(limits, " ")
+}
@@ -12,3 +12,92 @@ const (
 	ClientCfgQPS            = 10
 	ClientCfgBurst          = 10
 )
+
+// annotations recording StorageClass parameters on PVC and PV
+const (
+	AnnProvisionerVGSelector                = "volume-provisioner.pingcap.com/vgSelector"
+	AnnProvisionerLVType                    = "volume-provisioner.pingcap.com/lvType"
+	AnnProvisionerStripes                   = "volume-provisioner.pingcap.com/stripes"
+	AnnProvisionerStripeSize                = "volume-provisioner.pingcap.com/stripeSize"
+	AnnProvisionerCachePVTag                = "volume-provisioner.pingcap.com/cachePVTag"
+	AnnProvisionerCacheMode                 = "volume-provisioner.pingcap.com/cacheMode"
+	AnnProvisionerCacheRatio                = "volume-provisioner.pingcap.com/cacheRatio"
+	AnnProvisionerEncrypted                 = "volume-provisioner.pingcap.com/encrypted"
+	AnnProvisionerEncryptionSecretNamespace = "volume-provisioner.pingcap.com/encryptionSecretNamespace"
+	AnnProvisionerEncryptionSecretName      = "volume-provisioner.pingcap.com/encryptionSecretName"
+	AnnProvisionerEncryptionKeyGenerated    = "volume-provisioner.pingcap.com/encryptionKeyGenerated"
+	AnnProvisionerErasePolicy               = "volume-provisioner.pingcap.com/erasePolicy"
+	AnnProvisionerEraseOn                   = "volume-provisioner.pingcap.com/eraseOn"
+	AnnProvisionerAutoGrowThreshold         = "volume-provisioner.pingcap.com/autoGrowThreshold"
+	AnnProvisionerAutoGrowStep              = "volume-provisioner.pingcap.com/autoGrowStep"
+	AnnProvisionerAutoGrowMaxSize           = "volume-provisioner.pingcap.com/autoGrowMaxSize"
+	AnnProvisionerReadBPS                   = "volume-provisioner.pingcap.com/readBPS"
+	AnnProvisionerWriteBPS                  = "volume-provisioner.pingcap.com/writeBPS"
+	AnnProvisionerReadIOPS                  = "volume-provisioner.pingcap.com/readIOPS"
+	AnnProvisionerWriteIOPS                 = "volume-provisioner.pingcap.com/writeIOPS"
+	AnnProvisionerDirMode                   = "volume-provisioner.pingcap.com/dirMode"
+	AnnProvisionerUID                       = "volume-provisioner.pingcap.com/uid"
+	AnnProvisionerGID                       = "volume-provisioner.pingcap.com/gid"
+	AnnProvisionerFSGroup                   = "volume-provisioner.pingcap.com/fsGroup"
+)
+
+// annotations reporting volume status
+const (
+	AnnProvisionerImported      = "volume-provisioner.pingcap.com/imported"
+	AnnProvisionerCacheStats    = "volume-provisioner.pingcap.com/cacheStats"
+	AnnProvisionerEraseProgress = "volume-provisioner.pingcap.com/eraseProgress"
+	AnnProvisionerFailed        = "volume-provisioner.pingcap.com/failed"
+	// AnnProvisionerMigratedFrom is the node a PV is migrated from
+	AnnProvisionerMigratedFrom = "volume-provisioner.pingcap.com/migratedFrom"
+	// AnnProvisionerMigrationClaim is the PVC recreated to bind the migrated
+	// PV, it's removed once the migration is done
+	AnnProvisionerMigrationClaim = "volume-provisioner.pingcap.com/migrationClaim"
+	// AnnProvisionerMigrationOwner is the UID of the source PVC owning the
+	// migrated LV until the migration is done
+	AnnProvisionerMigrationOwner = "volume-provisioner.pingcap.com/migrationOwner"
+)
+
+// annotations set by users to override the default behavior
+const (
+	AnnProvisionerForceFormat = "volume-provisioner.pingcap.com/forceFormat"
+)
+
+// node annotations set by users to decommission the node, the volumes are
+// copied to the target node if it's set
+const (
+	AnnNodeDecommission       = "volume-provisioner.pingcap.com/decommission"
+	AnnNodeDecommissionTarget = "volume-provisioner.pingcap.com/decommissionTarget"
+)
+
+// node annotations published by the volume manager
+const (
+	AnnNodeVGs = "volume-provisioner.pingcap.com/vgs"
+	// AnnNodeDecommissionStatus reports the progress of the decommission
+	AnnNodeDecommissionStatus = "volume-provisioner.pingcap.com/decommissionStatus"
+)
+
+// StorageClass parameters
+const (
+	ParamVGSelector        = "vgSelector"
+	ParamLVType            = "lvType"
+	ParamStripes           = "stripes"
+	ParamStripeSize        = "stripeSize"
+	ParamCachePVTag        = "cachePVTag"
+	ParamCacheMode         = "cacheMode"
+	ParamCacheRatio        = "cacheRatio"
+	ParamEncrypted         = "encrypted"
+	ParamEncryptionSecret  = "encryptionSecret"
+	ParamErasePolicy       = "erasePolicy"
+	ParamEraseOn           = "eraseOn"
+	ParamLVNameTemplate    = "lvNameTemplate"
+	ParamAutoGrowThreshold = "autoGrowThreshold"
+	ParamAutoGrowStep      = "autoGrowStep"
+	ParamAutoGrowMaxSize   = "autoGrowMaxSize"
+	ParamReadBPS           = "readBPS"
+	ParamWriteBPS          = "writeBPS"
+	ParamReadIOPS          = "readIOPS"
+	ParamWriteIOPS         = "writeIOPS"
+	ParamDirMode           = "dirMode"
+	ParamUID               = "uid"
+	ParamGID               = "gid"
+)
@@ -0,0 +1,134 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	LVTypeLinear  = "linear"
+	LVTypeStriped = "striped"
+	LVTypeRaid1   = "raid1"
+	LVTypeRaid10  = "raid10"
+
+	defaultStripes = 2
+	// LVM stripe sizes are powers of two from 4KiB
+	minStripeSize = 4 << 10
+)
+
+// LVLayout is how a LV is laid out on the PVs of its VG
+type LVLayout struct {
+	Type       string
+	Stripes    int
+	StripeSize string
+}
+
+// ParseLVLayout parses lvType, stripes and stripeSize parameters, missing
+// parameters fall back to a linear LV
+func ParseLVLayout(params map[string]string) (LVLayout, error) {
+	layout := LVLayout{
+		Type:       params[ParamLVType],
+		StripeSize: params[ParamStripeSize],
+	}
+	if layout.Type == "" {
+		layout.Type = LVTypeLinear
+	}
+	switch layout.Type {
+	case LVTypeLinear, LVTypeRaid1:
+		if layout.StripeSize != "" || params[ParamStripes] != "" {
+			return layout, fmt.Errorf("stripes and stripeSize only apply to %s and %s LVs, not %s", LVTypeStriped, LVTypeRaid10, layout.Type)
+		}
+		return LVLayout{Type: layout.Type}, nil
+	case LVTypeStriped, LVTypeRaid10:
+	default:
+		return layout, fmt.Errorf("unsupported lvType %s", layout.Type)
+	}
+	if layout.StripeSize != "" {
+		if err := validateStripeSize(layout.StripeSize); err != nil {
+			return layout, err
+		}
+	}
+	layout.Stripes = defaultStripes
+	if s := params[ParamStripes]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 2 {
+			return layout, fmt.Errorf("invalid stripes %s, must be a number not less than 2", s)
+		}
+		layout.Stripes = n
+	}
+	return layout, nil
+}
+
+// validateStripeSize checks the stripeSize is a power of two of at least
+// 4KiB, it's in KiB without a unit as lvcreate takes it, e.g. 64 or 64k
+func validateStripeSize(s string) error {
+	units := map[string]int64{"": 1 << 10, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30}
+	num := strings.TrimRight(s, "kKmMgG")
+	unit, ok := units[strings.ToLower(s[len(num):])]
+	n, err := strconv.ParseInt(num, 10, 64)
+	if !ok || err != nil || n <= 0 {
+		return fmt.Errorf("invalid stripeSize %s, must be a size like 64k", s)
+	}
+	size := n * unit
+	if size < minStripeSize || size&(size-1) != 0 {
+		return fmt.Errorf("invalid stripeSize %s, must be a power of two not less than 4k", s)
+	}
+	return nil
+}
+
+// Annotate records the layout in the annotations of a PVC
+func (l LVLayout) Annotate(ann map[string]string) {
+	ann[AnnProvisionerLVType] = l.Type
+	ann[AnnProvisionerStripes] = ""
+	if l.Stripes > 0 {
+		ann[AnnProvisionerStripes] = strconv.Itoa(l.Stripes)
+	}
+	ann[AnnProvisionerStripeSize] = l.StripeSize
+}
+
+// LVLayoutFromAnnotations parses the layout recorded by Annotate
+func LVLayoutFromAnnotations(ann map[string]string) (LVLayout, error) {
+	return ParseLVLayout(map[string]string{
+		ParamLVType:     ann[AnnProvisionerLVType],
+		ParamStripes:    ann[AnnProvisionerStripes],
+		ParamStripeSize: ann[AnnProvisionerStripeSize],
+	})
+}
+
+// PVRequirement returns how many distinct PVs a LV of the size needs and
+// how much free space each of them must have
+func (l LVLayout) PVRequirement(size int64) (int, int64) {
+	switch l.Type {
+	case LVTypeStriped:
+		return l.Stripes, divideCeil(size, int64(l.Stripes))
+	case LVTypeRaid1:
+		return 2, size
+	case LVTypeRaid10:
+		return 2 * l.Stripes, divideCeil(size, int64(l.Stripes))
+	}
+	return 1, size
+}
+
+// Fits reports whether the VG has enough PVs with enough free space for a
+// LV of the size
+func (l LVLayout) Fits(vg VGInfo, size int64) bool {
+	if vg.Free < size {
+		return false
+	}
+	if l.Type == LVTypeLinear {
+		return true
+	}
+	count, perPV := l.PVRequirement(size)
+	frees := make([]int64, 0, len(vg.PVs))
+	for _, pv := range vg.PVs {
+		frees = append(frees, pv.Free)
+	}
+	sort.Slice(frees, func(i, j int) bool { return frees[i] > frees[j] })
+	return len(frees) >= count && frees[count-1] >= perPV
+}
+
+func divideCeil(a, b int64) int64 {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,91 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLVLayout(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		layout LVLayout
+		err    bool
+	}{
+		{params: map[string]string{}, layout: LVLayout{Type: LVTypeLinear}},
+		{params: map[string]string{ParamLVType: LVTypeRaid1}, layout: LVLayout{Type: LVTypeRaid1}},
+		{params: map[string]string{ParamLVType: LVTypeStriped}, layout: LVLayout{Type: LVTypeStriped, Stripes: 2}},
+		{
+			params: map[string]string{ParamLVType: LVTypeStriped, ParamStripes: "4", ParamStripeSize: "64k"},
+			layout: LVLayout{Type: LVTypeStriped, Stripes: 4, StripeSize: "64k"},
+		},
+		{
+			params: map[string]string{ParamLVType: LVTypeRaid10, ParamStripeSize: "1M"},
+			layout: LVLayout{Type: LVTypeRaid10, Stripes: 2, StripeSize: "1M"},
+		},
+		{
+			params: map[string]string{ParamLVType: LVTypeStriped, ParamStripeSize: "128"},
+			layout: LVLayout{Type: LVTypeStriped, Stripes: 2, StripeSize: "128"},
+		},
+		{params: map[string]string{ParamLVType: "mirror"}, err: true},
+		{params: map[string]string{ParamLVType: LVTypeStriped, ParamStripes: "1"}, err: true},
+		{params: map[string]string{ParamLVType: LVTypeStriped, ParamStripes: "two"}, err: true},
+		{params: map[string]string{ParamLVType: LVTypeStriped, ParamStripeSize: "48k"}, err: true},
+		{params: map[string]string{ParamLVType: LVTypeStriped, ParamStripeSize: "2k"}, err: true},
+		{params: map[string]string{ParamLVType: LVTypeStriped, ParamStripeSize: "64x"}, err: true},
+		{params: map[string]string{ParamLVType: LVTypeStriped, ParamStripeSize: "k"}, err: true},
+		{params: map[string]string{ParamLVType: LVTypeLinear, ParamStripeSize: "64k"}, err: true},
+		{params: map[string]string{ParamLVType: LVTypeRaid1, ParamStripes: "2"}, err: true},
+		{params: map[string]string{ParamStripeSize: "64k"}, err: true},
+	}
+	for _, test := range tests {
+		layout, err := ParseLVLayout(test.params)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseLVLayout(%v) = %+v, want error", test.params, layout)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLVLayout(%v) failed: %v", test.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(layout, test.layout) {
+			t.Errorf("ParseLVLayout(%v) = %+v, want %+v", test.params, layout, test.layout)
+		}
+	}
+}
+
+func TestLVName(t *testing.T) {
+	params := LVNameParams{Namespace: "db", Name: "data-0", UID: "0a1b"}
+	tests := []struct {
+		tmpl string
+		name string
+		err  bool
+	}{
+		{tmpl: "", name: "pvc-0a1b"},
+		{tmpl: "{{ .Namespace }}.{{ .Name }}.{{ .UID }}", name: "db.data-0.0a1b"},
+		{tmpl: "{{ .Namespace", err: true},
+		{tmpl: "{{ .Zone }}", err: true},
+		{tmpl: "{{ .Namespace }}/{{ .Name }}", err: true},
+		{tmpl: "-{{ .Name }}", err: true},
+		{tmpl: "snapshot-{{ .Name }}", err: true},
+		{tmpl: "{{ .Name }}_rimage", err: true},
+		{tmpl: "..", err: true},
+	}
+	for _, test := range tests {
+		name, err := LVName(test.tmpl, params)
+		if test.err {
+			if err == nil {
+				t.Errorf("LVName(%q) = %s, want error", test.tmpl, name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("LVName(%q) failed: %v", test.tmpl, err)
+			continue
+		}
+		if name != test.name {
+			t.Errorf("LVName(%q) = %s, want %s", test.tmpl, name, test.name)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	// DefaultLVNameTemplate names LVs after the PVC UID which is never reused
+	DefaultLVNameTemplate = "pvc-{{ .UID }}"
+	// maxLVNameLen leaves room for the suffixes of LVM sub LVs and our cache pool
+	maxLVNameLen = 100
+
+	lvTagNamespace = "k8s.pvc.namespace="
+	lvTagName      = "k8s.pvc.name="
+	lvTagUID       = "k8s.pvc.uid="
+)
+
+// reserved by LVM for the sub LVs
+var lvNameReserved = []string{
+	"_cdata", "_cmeta", "_corig", "_cpool", "_cvol", "_mimage", "_mlog",
+	"_pmspare", "_rimage", "_rmeta", "_tdata", "_tmeta", "_vdata", "_vorigin",
+}
+
+// LVNameParams are the fields usable in LV name templates
+type LVNameParams struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+// LVName renders the LV name of a PVC from the template and validates it
+func LVName(tmpl string, params LVNameParams) (string, error) {
+	if tmpl == "" {
+		tmpl = DefaultLVNameTemplate
+	}
+	t, err := template.New("lvName").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid LV name template %s: %v", tmpl, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, params); err != nil {
+		return "", fmt.Errorf("failed to render LV name template %s: %v", tmpl, err)
+	}
+	name := buf.String()
+	if err := ValidateLVName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// ValidateLVName checks the name against the LVM naming rules
+func ValidateLVName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid LV name %q", name)
+	}
+	if len(name) > maxLVNameLen {
+		return fmt.Errorf("LV name %s is longer than %d", name, maxLVNameLen)
+	}
+	if name[0] == '-' {
+		return fmt.Errorf("LV name %s must not start with -", name)
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '+', r == '_', r == '.', r == '-':
+		default:
+			return fmt.Errorf("LV name %s contains invalid character %q", name, r)
+		}
+	}
+	if strings.HasPrefix(name, "snapshot") || strings.HasPrefix(name, "pvmove") {
+		return fmt.Errorf("LV name %s must not start with snapshot or pvmove", name)
+	}
+	for _, reserved := range lvNameReserved {
+		if strings.Contains(name, reserved) {
+			return fmt.Errorf("LV name %s must not contain %s", name, reserved)
+		}
+	}
+	return nil
+}
+
+// LVOwnerTags returns the LV tags recording the PVC owning the LV
+func LVOwnerTags(ns, name, uid string) []string {
+	return []string{lvTagNamespace + ns, lvTagName + name, lvTagUID + uid}
+}
+
+// LVOwner returns the namespace, name and UID of the PVC recorded in LV tags
+func LVOwner(tags []string) (ns, name, uid string) {
+	for _, tag := range tags {
+		switch {
+		case strings.HasPrefix(tag, lvTagNamespace):
+			ns = strings.TrimPrefix(tag, lvTagNamespace)
+		case strings.HasPrefix(tag, lvTagName):
+			name = strings.TrimPrefix(tag, lvTagName)
+		case strings.HasPrefix(tag, lvTagUID):
+			uid = strings.TrimPrefix(tag, lvTagUID)
+		}
+	}
+	return
+}
+
+// LVOwnerUID returns the UID of the PVC owning the LV, or empty string if the
+// LV isn't tagged
+func LVOwnerUID(tags []string) string {
+	_, _, uid := LVOwner(tags)
+	return uid
+}
+
+// IsLVOwnerTag reports whether the tag is one of LVOwnerTags
+func IsLVOwnerTag(tag string) bool {
+	return strings.HasPrefix(tag, lvTagNamespace) || strings.HasPrefix(tag, lvTagName) || strings.HasPrefix(tag, lvTagUID)
+}
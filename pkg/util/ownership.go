@@ -0,0 +1,108 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// paramFSGroup is only recorded from the pod security context, it's not a
+// StorageClass parameter
+const paramFSGroup = "fsGroup"
+
+// OwnershipOptions describes the owner and permission bits of the root of a
+// newly formatted filesystem, -1 and 0 mean unset
+type OwnershipOptions struct {
+	// Mode is the octal permission bits including setuid, setgid and sticky
+	Mode    uint32
+	UID     int
+	GID     int
+	FSGroup int
+}
+
+// ParseOwnershipOptions parses dirMode, uid and gid parameters
+func ParseOwnershipOptions(params map[string]string) (OwnershipOptions, error) {
+	opts := OwnershipOptions{UID: -1, GID: -1, FSGroup: -1}
+	if s := params[ParamDirMode]; s != "" {
+		mode, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || mode > 07777 {
+			return opts, fmt.Errorf("invalid dirMode %s, must be octal permission bits, e.g. 0775", s)
+		}
+		opts.Mode = uint32(mode)
+	}
+	for param, id := range map[string]*int{ParamUID: &opts.UID, ParamGID: &opts.GID, paramFSGroup: &opts.FSGroup} {
+		s := params[param]
+		if s == "" {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 0 {
+			return opts, fmt.Errorf("invalid %s %s, must be a non-negative integer", param, s)
+		}
+		*id = v
+	}
+	return opts, nil
+}
+
+// OwnershipOptionsFromAnnotations parses the options recorded by Annotate or
+// set by users on the PVC
+func OwnershipOptionsFromAnnotations(ann map[string]string) (OwnershipOptions, error) {
+	return ParseOwnershipOptions(map[string]string{
+		ParamDirMode: ann[AnnProvisionerDirMode],
+		ParamUID:     ann[AnnProvisionerUID],
+		ParamGID:     ann[AnnProvisionerGID],
+		paramFSGroup: ann[AnnProvisionerFSGroup],
+	})
+}
+
+// Annotate records the options in the annotations of a PVC, the options
+// already set by users on the PVC are kept
+func (o OwnershipOptions) Annotate(ann map[string]string) {
+	set := func(key, value string) {
+		if ann[key] == "" {
+			ann[key] = value
+		}
+	}
+	if o.Mode != 0 {
+		set(AnnProvisionerDirMode, fmt.Sprintf("%04o", o.Mode))
+	}
+	if o.UID >= 0 {
+		set(AnnProvisionerUID, strconv.Itoa(o.UID))
+	}
+	if o.GID >= 0 {
+		set(AnnProvisionerGID, strconv.Itoa(o.GID))
+	}
+	if o.FSGroup >= 0 {
+		set(AnnProvisionerFSGroup, strconv.Itoa(o.FSGroup))
+	}
+}
+
+// Owner returns the owner to chown to and the permission bits to chmod to,
+// fsGroup applies as kubelet does for other volumes when no gid is set: the
+// directory is group writable and new files inherit the group. It returns
+// -1 for the ids and 0 for the mode to keep them untouched.
+func (o OwnershipOptions) Owner() (uid, gid int, mode os.FileMode) {
+	uid, gid = o.UID, o.GID
+	bits := o.Mode
+	if gid < 0 && o.FSGroup >= 0 {
+		gid = o.FSGroup
+		if bits == 0 {
+			bits = 0775
+		}
+		bits |= 02070
+	}
+	if bits == 0 {
+		return uid, gid, 0
+	}
+	mode = os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return uid, gid, mode
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"encoding/json"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// VGInfo is the summary of a node's VG published in node annotation
+type VGInfo struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+	Size int64    `json:"size"`
+	Free int64    `json:"free"`
+	PVs  []PVInfo `json:"pvs,omitempty"`
+}
+
+// PVInfo is the summary of a PV in a VG
+type PVInfo struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+	Free int64    `json:"free"`
+}
+
+// NodeVGs returns the VGs published by the volume manager of the node
+func NodeVGs(node *v1.Node) ([]VGInfo, error) {
+	var vgs []VGInfo
+	data := node.GetAnnotations()[AnnNodeVGs]
+	if data == "" {
+		return vgs, nil
+	}
+	if err := json.Unmarshal([]byte(data), &vgs); err != nil {
+		return nil, err
+	}
+	return vgs, nil
+}
+
+// MatchVGSelector reports whether the tags contain every tag of the selector,
+// selector is a comma separated list of tags, e.g. tier=ssd,zone=a
+func MatchVGSelector(selector string, tags []string) bool {
+	tagSet := map[string]bool{}
+	for _, tag := range tags {
+		tagSet[tag] = true
+	}
+	for _, tag := range strings.Split(selector, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !tagSet[tag] {
+			return false
+		}
+	}
+	return true
+}
+
+// HasTag reports whether the LVM tags contain the tag
+func HasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// VGTagLabel returns the node label key of a VG tag, e.g. tag tier=ssd of
+// domain pingcap.com is labeled as vg.pingcap.com/tier-ssd
+func VGTagLabel(domainName, tag string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '-'
+	}, tag)
+	name = strings.Trim(name, "-_.")
+	if len(name) > 63 {
+		name = strings.Trim(name[:63], "-_.")
+	}
+	return VGTagLabelPrefix(domainName) + name
+}
+
+func VGTagLabelPrefix(domainName string) string {
+	return "vg." + domainName + "/"
+}
+
+// StorageDegradedTaintKey returns the key of the taint on nodes with
+// degraded storage, e.g. storage.pingcap.com/degraded
+func StorageDegradedTaintKey(domainName string) string {
+	return "storage." + domainName + "/degraded"
+}
+
+// StorageGroup returns the API group of the custom resources of the
+// manager, e.g. storage.pingcap.com
+func StorageGroup(domainName string) string {
+	return "storage." + domainName
+}
+
+// NodeDecommissioning reports whether the node is being decommissioned, new
+// volumes must not be placed on it
+func NodeDecommissioning(node *v1.Node) bool {
+	return node.GetAnnotations()[AnnNodeDecommission] == "true"
+}